@@ -4,14 +4,44 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 // backend wraps the backend framework and adds a map for storing key value pairs
 type backend struct {
 	*framework.Backend
+
+	// clientOptions are applied to every cloudflare client created by the
+	// backend. Tests use them to point the backend at a fake API.
+	clientOptions []cloudflare.Option
+
+	// lock protects the root credentials. Operations that replace one
+	// (configuration writes and rotations) take the write lock while operations
+	// that use it to manage tokens take the read lock.
+	lock sync.RWMutex
+
+	// clientMutex protects cachedClients, which holds the client of each
+	// connection. Clients are built on first use and dropped whenever the
+	// configuration of their connection changes.
+	clientMutex   sync.RWMutex
+	cachedClients map[string]*tokenClient
+
+	// storage is the storage of the mount, which is used to reload the expiry
+	// of a root token when another node changes its connection.
+	storage logical.Storage
+
+	// expiryMutex protects rootExpiries, which holds the expiry of the root
+	// token of each connection that has one so responses can carry expiry
+	// warnings without reading storage.
+	expiryMutex  sync.RWMutex
+	rootExpiries map[string]rootExpiry
 }
 
 var _ logical.Factory = Factory
@@ -26,6 +56,7 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 	if conf == nil {
 		return nil, fmt.Errorf("configuration passed into backend is nil")
 	}
+	b.storage = conf.StorageView
 
 	if err := b.Setup(ctx, conf); err != nil {
 		return nil, err
@@ -35,17 +66,31 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 }
 
 func newBackend() (*backend, error) {
-	b := &backend{}
+	b := &backend{
+		cachedClients: make(map[string]*tokenClient),
+		rootExpiries:  make(map[string]rootExpiry),
+	}
 
 	b.Backend = &framework.Backend{
 		Help:        strings.TrimSpace(backendHelp),
 		BackendType: logical.TypeLogical,
+		PathsSpecial: &logical.Paths{
+			SealWrapStorage: []string{
+				configTokenKey,
+				pendingRotationKey,
+				connectionPrefix,
+				connectionPendingRotationPrefix,
+			},
+		},
 		Paths: framework.PathAppend(
 			b.paths(),
 		),
 		Secrets: []*framework.Secret{
 			secretToken(b),
 		},
+		InitializeFunc: b.initialize,
+		Invalidate:     b.invalidate,
+		PeriodicFunc:   b.periodicFunc,
 	}
 
 	return b, nil
@@ -54,11 +99,110 @@ func newBackend() (*backend, error) {
 func (b *backend) paths() []*framework.Path {
 	return []*framework.Path{
 		pathConfigToken(b),
+		pathListConnections(b),
+		pathConnections(b),
+		pathConnectionRotateRoot(b),
 		pathCredsCreate(b),
 		pathRoles(b),
+		pathRoleValidate(b),
 		pathListRoles(b),
 		pathConfigRotateRoot(b),
 		pathConfigLease(b),
+		pathConfigNameTemplate(b),
+		pathPermissionGroups(b),
+		pathListTokens(b),
+		pathTokens(b),
+	}
+}
+
+// HandleRequest wraps the framework's request handling to warn on every
+// response while the root token of any connection is close to expiring.
+// Requests without a response are given one to carry the warnings, except
+// for rollbacks, which Vault does not return to a client.
+func (b *backend) HandleRequest(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	resp, err := b.Backend.HandleRequest(ctx, req)
+	if err != nil || req.Operation == logical.RollbackOperation {
+		return resp, err
+	}
+
+	warnings := b.rootExpiryWarnings(time.Now())
+	if len(warnings) == 0 {
+		return resp, nil
+	}
+	if resp == nil {
+		resp = &logical.Response{}
+	}
+	for _, warning := range warnings {
+		resp.AddWarning(warning)
+	}
+
+	return resp, nil
+}
+
+// initialize loads the expiry of the root token of every connection.
+func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	return b.loadRootExpiries(ctx, req.Storage)
+}
+
+// reset drops the cached cloudflare client of the named connection so the
+// next call to client rebuilds it from storage.
+func (b *backend) reset(name string) {
+	b.clientMutex.Lock()
+	defer b.clientMutex.Unlock()
+
+	delete(b.cachedClients, name)
+}
+
+// periodicFunc performs the backend's scheduled maintenance. It only runs
+// where storage is writable and shared with the primary.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// keep the cached expiries in line with storage on every node, including
+	// the ones that skip the maintenance below
+	var result *multierror.Error
+	if err := b.loadRootExpiries(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	replicationState := b.System().ReplicationState()
+	if (!b.System().LocalMount() && replicationState.HasState(consts.ReplicationPerformanceSecondary)) ||
+		replicationState.HasState(consts.ReplicationDRSecondary|consts.ReplicationPerformanceStandby) {
+		return result.ErrorOrNil()
+	}
+
+	names, err := b.connectionNames(ctx, req.Storage)
+	if err != nil {
+		return multierror.Append(result, err).ErrorOrNil()
+	}
+
+	for _, name := range names {
+		if err := b.rotateRootIfDue(ctx, req.Storage, name); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if err := b.deleteRetiredRootTokens(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	for _, name := range names {
+		if err := b.extendRootIfExpiring(ctx, req.Storage, name); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// invalidate clears the cached client of a connection and reloads the expiry
+// of its root token when its configuration is changed by another node, e.g.
+// on performance standbys and replicas.
+func (b *backend) invalidate(ctx context.Context, key string) {
+	switch {
+	case key == configTokenKey:
+		b.reset("")
+		b.reloadRootExpiry(ctx, "")
+	case strings.HasPrefix(key, connectionPrefix):
+		name := strings.TrimPrefix(key, connectionPrefix)
+		b.reset(name)
+		b.reloadRootExpiry(ctx, name)
 	}
 }
 
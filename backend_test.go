@@ -3,30 +3,28 @@ package cloudflare
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/bloominlabs/vault-plugin-secrets-cloudflare/internal/fakecloudflare"
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
 )
 
-func testCreateToken(t *testing.T, c *cloudflare.API, token cloudflare.APIToken) (cloudflare.APIToken, func(), error) {
-	token, err := c.CreateAPIToken(context.TODO(), token)
-	cleanup := func() {
-		c.DeleteAPIToken(context.TODO(), token.ID)
-		if err != nil {
-			t.Fatalf("failed to delete token '%s'. please ensure it is deleted in cloudflare. err: %s", token.ID, err.Error())
-		}
-	}
-
-	return token, cleanup, err
-}
+// testBackend returns a backend whose cloudflare clients talk to a fresh fake
+// API that is torn down when the test finishes.
+func testBackend(t *testing.T) (logical.Backend, *logical.BackendConfig, *fakecloudflare.Server) {
+	t.Helper()
 
-func TestBackend_config_token(t *testing.T) {
-	CLOUDFLARE_TOKEN := os.Getenv("TEST_CLOUDFLARE_TOKEN")
+	fake := fakecloudflare.NewServer()
+	t.Cleanup(fake.Close)
 
 	config := logical.TestBackendConfig()
 	config.StorageView = &logical.InmemStorage{}
@@ -34,16 +32,74 @@ func TestBackend_config_token(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	CLOUDFLARE_TOKEN_ID := ""
+	b.(*backend).clientOptions = fake.ClientOptions()
+
+	return b, config, fake
+}
+
+// testConfigureRoot writes a fresh root token from the fake API to
+// config/token and returns it.
+func testConfigureRoot(t *testing.T, b logical.Backend, config *logical.BackendConfig, fake *fakecloudflare.Server) cloudflare.APIToken {
+	t.Helper()
+
+	root := fake.RootToken()
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": root.Value}))
+
+	return root
+}
+
+// testHandleRequest sends req to b using the test storage. The test fails if
+// the request returns an error; error responses are returned to the caller.
+func testHandleRequest(t *testing.T, b logical.Backend, config *logical.BackendConfig, req *logical.Request) *logical.Response {
+	t.Helper()
+
+	req.Storage = config.StorageView
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("request to %s failed: resp:%#v err:%s", req.Path, resp, err)
+	}
 
-	client, _ := createClient(CLOUDFLARE_TOKEN)
+	return resp
+}
+
+// testRequest is testHandleRequest for a request made up of only an
+// operation, path and data.
+func testRequest(t *testing.T, b logical.Backend, config *logical.BackendConfig, operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+	t.Helper()
+
+	return testHandleRequest(t, b, config, &logical.Request{
+		Operation: operation,
+		Path:      path,
+		Data:      data,
+	})
+}
 
-	if client != nil {
-		resp, _ := client.VerifyAPIToken(context.TODO())
+// testRequireSuccess fails the test if resp is an error response and returns
+// it otherwise.
+func testRequireSuccess(t *testing.T, resp *logical.Response) *logical.Response {
+	t.Helper()
 
-		CLOUDFLARE_TOKEN_ID = resp.ID
+	if resp != nil && resp.IsError() {
+		t.Fatalf("unexpected error response: %#v", resp.Data)
 	}
 
+	return resp
+}
+
+func TestBackend_config_token(t *testing.T) {
+	b, config, fake := testBackend(t)
+	root := fake.RootToken()
+	readOnly := fake.AddToken(cloudflare.APIToken{
+		Name: "read-only",
+		Policies: []cloudflare.APITokenPolicies{
+			{
+				Effect:           "allow",
+				Resources:        map[string]interface{}{"com.cloudflare.api.user.*": "*"},
+				PermissionGroups: []cloudflare.APITokenPermissionGroups{{ID: "0cc3a61731504c89b99ec1be78b77aa0", Name: "API Tokens Read"}},
+			},
+		},
+	})
+
 	testCases := []struct {
 		name                  string
 		configData            *rootTokenConfig
@@ -69,55 +125,162 @@ func TestBackend_config_token(t *testing.T) {
 		// 	nil,
 		// 	map[string]interface{}{"token": CLOUDFLARE_TOKEN},
 		// },
+		{
+			"errorsWithoutTokenWritePermission",
+			&rootTokenConfig{Token: readOnly.Value},
+			map[string]interface{}{"error": fmt.Sprintf("provided token (%s) is missing the 'API Tokens Write' permission required to create tokens", readOnly.ID)},
+			map[string]interface{}{"error": "configuration does not exist. did you configure 'config/token'?"},
+		},
 		{
 			"succeedsWithValidToken",
-			&rootTokenConfig{Token: CLOUDFLARE_TOKEN},
+			&rootTokenConfig{Token: root.Value},
 			nil,
-			map[string]interface{}{"id": CLOUDFLARE_TOKEN_ID, "token": CLOUDFLARE_TOKEN},
+			map[string]interface{}{
+				"auth_type":       "api_token",
+				"id":              root.ID,
+				"masked_token":    "************************************" + root.Value[36:],
+				"email":           "",
+				"masked_key":      "",
+				"account_id":      "",
+				"expose_token":    false,
+				"api_base_url":    "",
+				"request_timeout": int64(0),
+				"proxy_url":       "",
+				"ca_cert":         "",
+				"masked_headers":  map[string]string(nil),
+
+				"rotation_period":   int64(0),
+				"rotation_schedule": "",
+				"rotation_window":   int64(0),
+				"next_rotation":     "",
+
+				"name":       root.Name,
+				"policies":   root.Policies,
+				"condition":  (*cloudflare.APITokenCondition)(nil),
+				"not_before": "",
+				"expires_on": "",
+
+				"expiry_warning_threshold": int64(7 * 24 * 60 * 60),
+				"auto_extend":              false,
+				"auto_extend_period":       int64(30 * 24 * 60 * 60),
+
+				"permission_groups_refresh_interval": int64(24 * 60 * 60),
+			},
 		},
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			confReq := &logical.Request{
-				Operation: logical.UpdateOperation,
-				Path:      "config/token",
-				Storage:   config.StorageView,
-				Data:      nil,
-			}
-
+			var data map[string]interface{}
 			if testCase.configData != nil {
-				confReq.Data = map[string]interface{}{
+				data = map[string]interface{}{
 					"token": testCase.configData.Token,
 				}
 			}
 
-			resp, err := b.HandleRequest(context.Background(), confReq)
-			if err != nil {
-				t.Fatal(err)
-			}
-
+			resp := testRequest(t, b, config, logical.UpdateOperation, "config/token", data)
 			if testCase.expectedWriteResponse == nil {
 				assert.Nil(t, resp)
 			} else {
 				assert.Equal(t, testCase.expectedWriteResponse, resp.Data)
 			}
 
-			confReq.Operation = logical.ReadOperation
-			resp, err = b.HandleRequest(context.Background(), confReq)
+			resp = testRequest(t, b, config, logical.ReadOperation, "config/token", nil)
 
+			// last_rotated is set to the time the token was written
+			if lastRotated, ok := resp.Data["last_rotated"]; ok {
+				assert.NotEmpty(t, lastRotated)
+				delete(resp.Data, "last_rotated")
+			}
 			assert.Equal(t, testCase.expectedReadResponse, resp.Data)
 		})
 	}
 }
 
-func TestBackend_rotate_root(t *testing.T) {
-	CLOUDFLARE_TOKEN := os.Getenv("TEST_CLOUDFLARE_TOKEN")
+func TestBackend_config_token_expose(t *testing.T) {
+	b, config, fake := testBackend(t)
+	root := testConfigureRoot(t, b, config, fake)
 
-	if CLOUDFLARE_TOKEN == "" {
-		t.Skip("missing 'TEST_CLOUDFLARE_TOKEN'. skipping...")
-	}
+	data := testRequest(t, b, config, logical.ReadOperation, "config/token", nil).Data
+	assert.NotContains(t, data, "token")
+	assert.Equal(t, maskToken(root.Value), data["masked_token"])
+
+	// exposing the stored token without providing it is refused
+	resp := testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"expose_token": true})
+	assert.Equal(t, map[string]interface{}{"error": "'expose_token' can only be enabled in the same request that sets 'token' or 'key'"}, resp.Data)
+	data = testRequest(t, b, config, logical.ReadOperation, "config/token", nil).Data
+	assert.NotContains(t, data, "token")
+	assert.Equal(t, false, data["expose_token"])
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": root.Value, "expose_token": true}))
+	data = testRequest(t, b, config, logical.ReadOperation, "config/token", nil).Data
+	assert.Equal(t, root.Value, data["token"])
+	assert.Equal(t, true, data["expose_token"])
+
+	// other updates keep the token exposed, and it can always be hidden again
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"request_timeout": "10s"}))
+	assert.Equal(t, true, testRequest(t, b, config, logical.ReadOperation, "config/token", nil).Data["expose_token"])
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"expose_token": false}))
+	assert.NotContains(t, testRequest(t, b, config, logical.ReadOperation, "config/token", nil).Data, "token")
+
+	// writing a new token without the flag hides it again
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": root.Value, "expose_token": true}))
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": root.Value}))
+	assert.NotContains(t, testRequest(t, b, config, logical.ReadOperation, "config/token", nil).Data, "token")
+
+	assert.Contains(t, b.SpecialPaths().SealWrapStorage, configTokenKey)
+}
+
+func TestBackend_config_token_api_key(t *testing.T) {
+	b, config, fake := testBackend(t)
+	key := fake.AddAPIKey("admin@example.com")
+
+	resp := testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"auth_type": "api_key", "email": "admin@example.com"})
+	assert.Equal(t, map[string]interface{}{"error": "Missing 'email' or 'key' in configuration request"}, resp.Data)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"auth_type": "api_key", "email": "admin@example.com", "key": "0000000000000000000000000000000000000000"})
+	assert.Equal(t, map[string]interface{}{"error": "encountered error when verifying api key: HTTP status 403: Unknown X-Auth-Key or X-Auth-Email (9103)"}, resp.Data)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"auth_type": "api_key", "email": "admin@example.com", "key": key, "rotation_period": "720h"})
+	assert.Equal(t, map[string]interface{}{"error": "automatic rotation requires auth_type 'api_token'"}, resp.Data)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"auth_type": "api_key", "email": "admin@example.com", "key": key})
+	assert.Nil(t, resp)
+
+	data := testRequest(t, b, config, logical.ReadOperation, "config/token", nil).Data
+	assert.Equal(t, "api_key", data["auth_type"])
+	assert.Equal(t, "admin@example.com", data["email"])
+	assert.Equal(t, maskToken(key), data["masked_key"])
+	assert.NotContains(t, data, "key")
+
+	// the key can still mint scoped tokens
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy}))
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "creds/test", nil))
+	_, ok := fake.Token(resp.Data["id"].(string))
+	assert.True(t, ok)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", nil)
+	assert.Equal(t, map[string]interface{}{"error": "config/rotate-root requires auth_type 'api_token'. rotate the Global API Key in the cloudflare dashboard instead"}, resp.Data)
+
+	// migrating to a root token drops the key
+	root := fake.RootToken()
+	resp = testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"auth_type": "api_token", "token": root.Value})
+	assert.Nil(t, resp)
+
+	data = testRequest(t, b, config, logical.ReadOperation, "config/token", nil).Data
+	assert.Equal(t, "api_token", data["auth_type"])
+	assert.Equal(t, root.ID, data["id"])
+	assert.Equal(t, "", data["email"])
+	assert.Equal(t, "", data["masked_key"])
+}
+
+func TestBackend_config_token_transport(t *testing.T) {
+	fake := fakecloudflare.NewServer()
+	defer fake.Close()
+	root := fake.RootToken()
 
+	// no client options are injected so the backend has to reach the fake
+	// through the configured api_base_url
 	config := logical.TestBackendConfig()
 	config.StorageView = &logical.InmemStorage{}
 	b, err := Factory(context.Background(), config)
@@ -125,211 +288,995 @@ func TestBackend_rotate_root(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	delta, _ := time.ParseDuration("30m")
-	deltaFromNow := time.Now().UTC().Truncate(time.Second).Add(delta)
 	testCases := []struct {
-		name string
+		name                  string
+		configData            map[string]interface{}
+		expectedWriteResponse map[string]interface{}
 	}{
 		{
-			"happyPath",
+			"errorsWithRelativeBaseURL",
+			map[string]interface{}{"token": root.Value, "api_base_url": "/client/v4"},
+			map[string]interface{}{"error": `invalid api_base_url "/client/v4": must be an absolute http(s) URL`},
+		},
+		{
+			"errorsWithReservedHeader",
+			map[string]interface{}{"token": root.Value, "api_base_url": fake.URL, "headers": map[string]interface{}{"authorization": "Bearer foo"}},
+			map[string]interface{}{"error": `header "authorization" is reserved for authenticating with cloudflare and cannot be overridden`},
+		},
+		{
+			"errorsWithInvalidCACert",
+			map[string]interface{}{"token": root.Value, "api_base_url": fake.URL, "ca_cert": "not a certificate"},
+			map[string]interface{}{"error": "failed to create cloudflare client: ca_cert does not contain any valid PEM encoded certificates"},
+		},
+		{
+			"succeedsWithBaseURLAndHeaders",
+			map[string]interface{}{"token": root.Value, "api_base_url": fake.URL + "/", "request_timeout": "5s", "headers": []string{"X-Gateway-Auth=secret"}},
+			nil,
 		},
 	}
+
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			client, err := createClient(CLOUDFLARE_TOKEN)
-			if err != nil {
-				t.Fatal(err)
+			resp := testRequest(t, b, config, logical.UpdateOperation, "config/token", testCase.configData)
+			if testCase.expectedWriteResponse != nil {
+				assert.Equal(t, testCase.expectedWriteResponse, resp.Data)
+				return
 			}
+			assert.Nil(t, resp)
+			assert.Equal(t, "secret", fake.LastRequestHeader().Get("X-Gateway-Auth"))
 
-			// Cloudflare does not allow creating tokens that can create other
-			// management tokens 'sub-token is not allowed to have permissions to
-			// manage other tokens' and a token is not allowed to roll itself unless
-			// it can manage other tokens. So instead we create an empty token and
-			// inject the token id of the empty token into the plugin configuration
-			// since the 'config/rotate-roll' rotates the id of the token.
-			emptyToken := cloudflare.APIToken{
-				Name:      fmt.Sprintf("vault-integration-test-%s-%d", testCase.name, time.Now().UnixNano()),
-				ExpiresOn: &deltaFromNow,
-				Policies:  []cloudflare.APITokenPolicies{},
-			}
-			emptyToken, tokenCleanup, err := testCreateToken(t, client, emptyToken)
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer tokenCleanup()
+			resp = testRequest(t, b, config, logical.ReadOperation, "config/token", nil)
+			assert.Equal(t, fake.URL+"/", resp.Data["api_base_url"])
+			assert.Equal(t, int64(5), resp.Data["request_timeout"])
+			assert.Equal(t, map[string]string{"X-Gateway-Auth": maskToken("secret")}, resp.Data["masked_headers"])
+			assert.NotContains(t, resp.Data, "headers")
+		})
+	}
+}
 
-			conf := &rootTokenConfig{TokenID: emptyToken.ID, Token: CLOUDFLARE_TOKEN}
-			entry, err := logical.StorageEntryJSON(configTokenKey, conf)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if err := config.StorageView.Put(context.TODO(), entry); err != nil {
-				t.Fatal(err)
-			}
+func TestBackend_config_token_expiry(t *testing.T) {
+	b, config, fake := testBackend(t)
 
-			confReq := &logical.Request{
-				Operation: logical.UpdateOperation,
-				Path:      "config/rotate-root",
-				Storage:   config.StorageView,
-				Data:      map[string]interface{}{},
-			}
+	expiresOn := time.Now().UTC().Add(48 * time.Hour).Truncate(time.Second)
+	root := fake.RootToken()
+	root.ExpiresOn = &expiresOn
+	root = fake.AddToken(root)
 
-			resp, err := b.HandleRequest(context.Background(), confReq)
-			if err != nil || (resp != nil && resp.IsError()) {
-				t.Fatalf("failed to rotate token: resp:%#v err:%s", resp, err)
-			}
+	resp := testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": root.Value, "auto_extend": true, "auto_extend_period": "24h"})
+	assert.Equal(t, map[string]interface{}{"error": "'auto_extend_period' must be longer than 'expiry_warning_threshold'"}, resp.Data)
+
+	// responses warn while the token is within the threshold, including
+	// requests that would otherwise return nothing
+	expectedWarning := fmt.Sprintf("the root token (%s) configured at 'config/token' expires at %s. extend it, set 'auto_extend', or configure a new token before then", root.ID, expiresOn.Format(time.RFC3339))
+	resp = testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": root.Value})
+	assert.Equal(t, []string{expectedWarning}, resp.Warnings)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy})
+	assert.False(t, resp.IsError())
+	assert.Equal(t, []string{expectedWarning}, resp.Warnings)
+
+	resp = testRequest(t, b, config, logical.DeleteOperation, "roles/test", nil)
+	assert.Nil(t, resp.Data)
+	assert.Equal(t, []string{expectedWarning}, resp.Warnings)
+
+	resp = testRequest(t, b, config, logical.ListOperation, "roles/", nil)
+	assert.Equal(t, []string{expectedWarning}, resp.Warnings)
+
+	resp = testRequest(t, b, config, logical.ReadOperation, "config/token", nil)
+	assert.Equal(t, expiresOn.Format(time.RFC3339), resp.Data["expires_on"])
+	assert.Equal(t, []string{expectedWarning}, resp.Warnings)
+
+	// the periodic function leaves the token alone unless auto_extend is set
+	runPeriodic := func() {
+		rollbackReq := logical.RollbackRequest("")
+		testHandleRequest(t, b, config, rollbackReq)
+	}
+	runPeriodic()
+	current, _ := fake.Token(root.ID)
+	assert.Equal(t, expiresOn, *current.ExpiresOn)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"auto_extend": true, "auto_extend_period": "720h"}))
+
+	runPeriodic()
+	current, _ = fake.Token(root.ID)
+	assert.WithinDuration(t, time.Now().Add(720*time.Hour), *current.ExpiresOn, time.Minute)
+	assert.Equal(t, root.Policies, current.Policies)
+	assert.Equal(t, root.Name, current.Name)
+
+	resp = testRequest(t, b, config, logical.ReadOperation, "config/token", nil)
+	assert.Equal(t, current.ExpiresOn.Format(time.RFC3339), resp.Data["expires_on"])
+	assert.Empty(t, resp.Warnings)
+}
+
+func TestBackend_config_token_expiry_cache(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+	cb := b.(*backend)
+
+	expiresOn := time.Now().UTC().Add(48 * time.Hour).Truncate(time.Second)
+	expiring := fake.RootToken()
+	expiring.ExpiresOn = &expiresOn
+	expiring = fake.AddToken(expiring)
+	expectedWarning := fmt.Sprintf("the root token (%s) configured at 'config/connections/other' expires at %s. extend it, set 'auto_extend', or configure a new token before then", expiring.ID, expiresOn.Format(time.RFC3339))
+
+	// another node writes a connection with an expiring token
+	other := &rootTokenConfig{connection: "other", Token: expiring.Value, TokenID: expiring.ID, ExpiresOn: &expiresOn}
+	entry, err := logical.StorageEntryJSON(connectionStorageKey("other"), other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, testRequest(t, b, config, logical.ListOperation, "roles/", nil).Warnings)
+
+	cb.invalidate(context.Background(), connectionStorageKey("other"))
+	assert.Equal(t, []string{expectedWarning}, testRequest(t, b, config, logical.ListOperation, "roles/", nil).Warnings)
+
+	// deleting the connection drops the warning
+	assert.Nil(t, testRequest(t, b, config, logical.DeleteOperation, "config/connections/other", nil))
+	assert.Empty(t, testRequest(t, b, config, logical.ListOperation, "roles/", nil).Warnings)
+
+	// the periodic function and initialization reload every connection
+	if err := config.StorageView.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+	testHandleRequest(t, b, config, logical.RollbackRequest(""))
+	assert.Equal(t, []string{expectedWarning}, testRequest(t, b, config, logical.ListOperation, "roles/", nil).Warnings)
+
+	cb.setRootExpiry("other", nil)
+	if err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: config.StorageView}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{expectedWarning}, testRequest(t, b, config, logical.ListOperation, "roles/", nil).Warnings)
+}
+
+func TestBackend_client_cache(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+	cb := b.(*backend)
+
+	first, err := cb.client(context.Background(), config.StorageView, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cb.client(context.Background(), config.StorageView, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Same(t, first, second, "expected the client to be cached")
+
+	// writing config/token replaces the cached client
+	root := testConfigureRoot(t, b, config, fake)
+	third, err := cb.client(context.Background(), config.StorageView, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotSame(t, second, third)
+	assert.Equal(t, root.Value, third.APIToken)
+
+	// changes made by another node are picked up through Invalidate
+	entry, err := logical.StorageEntryJSON(configTokenKey, &rootTokenConfig{Token: fake.RootToken().Value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+	b.InvalidateKey(context.Background(), configTokenKey)
+	fourth, err := cb.client(context.Background(), config.StorageView, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotSame(t, third, fourth)
+
+	// deleting config/token drops the client entirely
+	testRequireSuccess(t, testRequest(t, b, config, logical.DeleteOperation, "config/token", nil))
+	_, err = cb.client(context.Background(), config.StorageView, "")
+	assert.EqualError(t, err, "configuration does not exist. did you configure 'config/token'?")
+}
+
+func TestBackend_rotate_root(t *testing.T) {
+	b, config, fake := testBackend(t)
+
+	testCases := []struct {
+		name string
+	}{
+		{
+			"happyPath",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			root := testConfigureRoot(t, b, config, fake)
+
+			resp := testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", nil))
 			createdTokenID := resp.Data["id"].(string)
 
 			// Verify that the token configured in the backend is still valid
-			bClient, err := b.(*backend).client(context.TODO(), config.StorageView)
+			bClient, err := b.(*backend).client(context.TODO(), config.StorageView, "")
+			if err != nil {
+				t.Fatal(err)
+			}
 			verifyResp, _ := bClient.VerifyAPIToken(context.TODO())
 			assert.Equal(t, "active", verifyResp.Status)
 			assert.Equal(t, createdTokenID, verifyResp.ID)
 
 			// Verify the original token has been rotated invalid
-			client, err = createClient(emptyToken.Value)
+			client, err := createClient(&rootTokenConfig{Token: root.Value}, fake.ClientOptions()...)
 			if err != nil {
 				t.Fatal(err)
 			}
 			_, err = client.VerifyAPIToken(context.TODO())
-			assert.Equal(t, err.Error(), "HTTP status 401: Invalid API Token (1000)")
+			assert.EqualError(t, err, "HTTP status 401: Invalid API Token (1000)")
 
-			assert.Equal(t, createdTokenID, emptyToken.ID)
+			assert.Equal(t, createdTokenID, root.ID)
 		})
 	}
 }
 
-const synaticallyValidPolicy = `[
-	{
-		"effect": "allow",
-		"resources": {
-			"com.cloudflare.api.account.zone.eb78d65290b24279ba6f44721b3ea3c4": "*",
-			"com.cloudflare.api.account.zone.22b1de5f1c0e4b3ea97bb1e963b06a43": "*"
-		},
-		"permission_groups": [
-			{
-				"id": "c8fed203ed3043cba015a93ad1616f1f",
-				"name": "Zone Read"
-			},
-			{
-				"id": "82e64a83756745bbbb1c9c2701bf816b",
-				"name": "DNS Read"
-			}
-		]
+func TestBackend_rotate_root_recreate(t *testing.T) {
+	b, config, fake := testBackend(t)
+	root := testConfigureRoot(t, b, config, fake)
+
+	resp := testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", map[string]interface{}{"strategy": "shuffle"})
+	assert.Equal(t, map[string]interface{}{"error": `unknown rotation strategy "shuffle"`}, resp.Data)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", map[string]interface{}{"strategy": "recreate"})
+	assert.Equal(t, map[string]interface{}{"error": "the 'recreate' strategy requires 'minting_connection'"}, resp.Data)
+
+	// cloudflare refuses to let a token create a token that manages tokens
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/connections/other-token", map[string]interface{}{"token": fake.RootToken().Value}))
+	resp = testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", map[string]interface{}{"strategy": "recreate", "minting_connection": "other-token"})
+	assert.Equal(t, map[string]interface{}{"error": "minting connection 'other-token' must use auth_type 'api_key'. cloudflare does not allow API tokens to create tokens that can manage tokens"}, resp.Data)
+	client, err := createClient(&rootTokenConfig{Token: root.Value}, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
 	}
-]`
+	_, err = client.CreateAPIToken(context.Background(), cloudflare.APIToken{Name: "copy", Policies: root.Policies})
+	assert.EqualError(t, err, "HTTP status 400: sub-token is not allowed to have permissions to manage other tokens (1001)")
 
-func TestBackend_roles(t *testing.T) {
-	config := logical.TestBackendConfig()
-	config.StorageView = &logical.InmemStorage{}
-	b, err := Factory(context.Background(), config)
+	key := fake.AddAPIKey("admin@example.com")
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/connections/minter", map[string]interface{}{"auth_type": "api_key", "email": "admin@example.com", "key": key}))
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", map[string]interface{}{"strategy": "recreate", "minting_connection": "minter", "grace_period": "1h"}))
+	newID := resp.Data["id"].(string)
+	assert.NotEqual(t, root.ID, newID)
+	assert.Equal(t, root.ID, resp.Data["previous_id"])
+
+	created, ok := fake.Token(newID)
+	if !ok {
+		t.Fatalf("replacement token '%s' was not created", newID)
+	}
+	assert.Equal(t, root.Name, created.Name)
+	assert.Equal(t, root.Policies, created.Policies)
+
+	conf, err := b.(*backend).readConnection(context.Background(), config.StorageView, "")
 	if err != nil {
 		t.Fatal(err)
 	}
+	assert.Equal(t, newID, conf.TokenID)
+	assert.Equal(t, created.Value, conf.Token)
 
-	compactedValidPolicy, err := compactJSON(synaticallyValidPolicy)
+	// the old token survives until its grace period has passed
+	runPeriodic := func() {
+		testHandleRequest(t, b, config, logical.RollbackRequest(""))
+	}
+	runPeriodic()
+	_, ok = fake.Token(root.ID)
+	assert.True(t, ok, "expected old root token to be kept during the grace period")
+
+	entry, err := logical.StorageEntryJSON(retiredRootTokenPrefix+root.ID, &retiredRootToken{
+		TokenID:     root.ID,
+		DeleteAfter: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+	runPeriodic()
+	_, ok = fake.Token(root.ID)
+	assert.False(t, ok, "expected old root token to be deleted after the grace period")
+
+	retired, err := config.StorageView.List(context.Background(), retiredRootTokenPrefix)
 	if err != nil {
 		t.Fatal(err)
 	}
+	assert.Empty(t, retired)
+}
+
+func TestBackend_rotate_root_scheduled(t *testing.T) {
+	now := time.Now().UTC()
 
 	testCases := []struct {
-		name                  string
-		policy                map[string]interface{}
-		expectedWriteResponse map[string]interface{}
-		expectedReadResponse  map[string]interface{}
+		name            string
+		configData      map[string]interface{}
+		lastRotated     time.Time
+		expectedError   string
+		expectedRotated bool
 	}{
 		{
-			"succeedsWithNilPolicyDocument",
-			nil,
-			map[string]interface{}{"policy_document": ""},
-			nil,
+			"errorsWithPeriodAndSchedule",
+			map[string]interface{}{"rotation_period": "720h", "rotation_schedule": "@monthly"},
+			time.Time{},
+			"only one of 'rotation_period' or 'rotation_schedule' may be set",
+			false,
 		},
 		{
-			"succeedsWithMissingPolicyDocument",
-			map[string]interface{}{"policy_document": ""},
-			map[string]interface{}{"policy_document": ""},
-			nil,
+			"errorsWithInvalidSchedule",
+			map[string]interface{}{"rotation_schedule": "every tuesday"},
+			time.Time{},
+			`invalid rotation_schedule "every tuesday": expected exactly 5 fields, found 2: [every tuesday]`,
+			false,
 		},
 		{
-			"succeedsWithInvalidJSONPolicyDocument",
-			map[string]interface{}{"policy_document": "{'}"},
-			map[string]interface{}{"error": "cannot parse policy document: \"{'}\""},
-			nil,
+			"errorsWithWindowWithoutSchedule",
+			map[string]interface{}{"rotation_period": "720h", "rotation_window": "1h"},
+			time.Time{},
+			"'rotation_window' requires 'rotation_schedule'",
+			false,
 		},
-		// TODO: add more validation to the parsed struct
-		// {
-		// 	"errorsWhenJSONIsntList",
-		// 	map[string]interface{}{"policy_document": "{}"},
-		// 	map[string]interface{}{"error": "cannot parse policy document: \"{'}\""},
-		// 	nil,
-		// },
 		{
-			"succeedsWithValidJSONPolicyDocument",
-			map[string]interface{}{"policy_document": `[{"test": "test"}]`},
-			map[string]interface{}{"policy_document": `[{"test":"test"}]`},
-			map[string]interface{}{"policy_document": `[{"test":"test"}]`},
+			"skipsWhenDisabled",
+			map[string]interface{}{},
+			now.Add(-365 * 24 * time.Hour),
+			"",
+			false,
 		},
 		{
-			"succeedsWithValidPolicyDocument",
-			map[string]interface{}{"policy_document": synaticallyValidPolicy},
-			map[string]interface{}{"policy_document": compactedValidPolicy},
-			map[string]interface{}{"policy_document": compactedValidPolicy},
+			"skipsBeforePeriodElapsed",
+			map[string]interface{}{"rotation_period": "720h"},
+			now.Add(-24 * time.Hour),
+			"",
+			false,
+		},
+		{
+			"rotatesAfterPeriodElapsed",
+			map[string]interface{}{"rotation_period": "720h"},
+			now.Add(-721 * time.Hour),
+			"",
+			true,
+		},
+		{
+			"rotatesOnSchedule",
+			map[string]interface{}{"rotation_schedule": "* * * * *"},
+			now.Add(-2 * time.Minute),
+			"",
+			true,
+		},
+		{
+			"rotatesWithinWindow",
+			map[string]interface{}{"rotation_schedule": "0 * * * *", "rotation_window": "2h"},
+			now.Add(-2 * time.Hour),
+			"",
+			true,
+		},
+		{
+			"rotatesInLaterSlotAfterMissedWindow",
+			map[string]interface{}{"rotation_schedule": "* * * * *", "rotation_window": "1m"},
+			now.Add(-2 * time.Hour),
+			"",
+			true,
 		},
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			confReq := &logical.Request{
-				Operation: logical.UpdateOperation,
-				Path:      fmt.Sprintf("roles/%s", testCase.name),
-				Storage:   config.StorageView,
-				Data:      testCase.policy,
+			b, config, fake := testBackend(t)
+			root := fake.RootToken()
+
+			data := map[string]interface{}{"token": root.Value}
+			for k, v := range testCase.configData {
+				data[k] = v
 			}
+			resp := testRequest(t, b, config, logical.UpdateOperation, "config/token", data)
+			if testCase.expectedError != "" {
+				assert.Equal(t, map[string]interface{}{"error": testCase.expectedError}, resp.Data)
+				return
+			}
+			assert.Nil(t, resp)
 
-			resp, err := b.HandleRequest(context.Background(), confReq)
+			conf, err := b.(*backend).readConnection(context.Background(), config.StorageView, "")
 			if err != nil {
 				t.Fatal(err)
 			}
+			conf.LastRotated = testCase.lastRotated
+			if err := b.(*backend).writeConnection(context.Background(), config.StorageView, conf); err != nil {
+				t.Fatal(err)
+			}
 
-			assert.Equal(t, testCase.expectedWriteResponse, resp.Data)
+			testHandleRequest(t, b, config, logical.RollbackRequest(""))
 
-			confReq = &logical.Request{
-				Operation: logical.ReadOperation,
-				Path:      fmt.Sprintf("roles/%s", testCase.name),
-				Storage:   config.StorageView,
-				Data:      testCase.policy,
-			}
-			resp, err = b.HandleRequest(context.Background(), confReq)
+			conf, err = b.(*backend).readConnection(context.Background(), config.StorageView, "")
 			if err != nil {
 				t.Fatal(err)
 			}
+			if !testCase.expectedRotated {
+				assert.Equal(t, root.Value, conf.Token)
+				assert.Equal(t, testCase.lastRotated, conf.LastRotated)
+				return
+			}
 
-			var respData map[string]interface{} = nil
-			if testCase.expectedReadResponse != nil {
-				respData = resp.Data
+			rotated, _ := fake.Token(root.ID)
+			assert.NotEqual(t, root.Value, conf.Token)
+			assert.Equal(t, rotated.Value, conf.Token)
+			assert.WithinDuration(t, time.Now(), conf.LastRotated, time.Minute)
+
+			resp = testRequest(t, b, config, logical.ReadOperation, "config/token", nil)
+			assert.Equal(t, formatTime(conf.LastRotated), resp.Data["last_rotated"])
+			next, err := conf.nextRotation(time.Now())
+			if err != nil {
+				t.Fatal(err)
 			}
-			assert.Equal(t, testCase.expectedReadResponse, respData)
+			assert.True(t, next.After(time.Now()))
+			assert.Equal(t, formatTime(next), resp.Data["next_rotation"])
 		})
 	}
 }
 
-const validPolicy = `
-[{"effect":"allow","resources":{"com.cloudflare.api.account.zone.a1e23bc2933e158857087ff3310c4e40":"*"},"permission_groups":[{"id":"4755a26eedb94da69e1066d98aa820be","name":"DNS Write"}]}]
-`
+func TestBackend_next_rotation_missed_window(t *testing.T) {
+	conf := &rootTokenConfig{
+		RotationSchedule: "0 0 1 1 *",
+		RotationWindow:   time.Hour,
+		LastRotated:      time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
 
-func TestBackend_creds_create(t *testing.T) {
-	CLOUDFLARE_TOKEN := os.Getenv("TEST_CLOUDFLARE_TOKEN")
+	testCases := []struct {
+		name         string
+		now          time.Time
+		expectedNext time.Time
+	}{
+		{"withinWindow", time.Date(2025, 1, 1, 0, 30, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"waitsAfterMissedWindow", time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"dueInNextSlot", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"dueWithinWindowOfNextSlot", time.Date(2026, 1, 1, 0, 59, 0, 0, time.UTC), time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"waitsAfterSeveralMissedWindows", time.Date(2027, 1, 1, 2, 0, 0, 0, time.UTC), time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
 
-	if CLOUDFLARE_TOKEN == "" {
-		t.Skip("missing 'TEST_CLOUDFLARE_TOKEN'. skipping...")
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			next, err := conf.nextRotation(testCase.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, testCase.expectedNext, next.UTC())
+		})
 	}
 
-	config := logical.TestBackendConfig()
-	config.StorageView = &logical.InmemStorage{}
-	b, err := Factory(context.Background(), config)
+	// once the first window was missed, ticking every hour for two years still
+	// rotates in every later slot
+	rotations := 0
+	for now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC); now.Before(time.Date(2027, 6, 1, 0, 0, 0, 0, time.UTC)); now = now.Add(time.Hour) {
+		next, err := conf.nextRotation(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !now.Before(next) {
+			conf.LastRotated = now
+			rotations++
+		}
+	}
+	assert.Equal(t, 2, rotations)
+}
+
+func TestBackend_rotate_root_failures(t *testing.T) {
+	rotate := func(t *testing.T, b logical.Backend, config *logical.BackendConfig) *logical.Response {
+		return testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", nil)
+	}
+	configuredToken := func(t *testing.T, b logical.Backend, config *logical.BackendConfig) string {
+		conf, err := b.(*backend).readConnection(context.Background(), config.StorageView, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conf.Token
+	}
+	pendingRotationExists := func(t *testing.T, config *logical.BackendConfig) bool {
+		entry, err := config.StorageView.Get(context.Background(), pendingRotationKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry != nil
+	}
+
+	t.Run("leavesTokenInPlaceWhenRollFails", func(t *testing.T) {
+		b, config, fake := testBackend(t)
+		root := testConfigureRoot(t, b, config, fake)
+
+		fake.Fail(http.MethodPut, "/user/tokens/"+root.ID+"/value", http.StatusInternalServerError, false)
+		resp := rotate(t, b, config)
+		assert.Equal(t, map[string]interface{}{
+			"error": fmt.Sprintf("failed to roll root token (%s). the existing token was left in place. err: HTTP status 500: Injected failure (10000)", root.ID),
+		}, resp.Data)
+		assert.Equal(t, root.Value, configuredToken(t, b, config))
+		assert.False(t, pendingRotationExists(t, config))
+
+		testRequireSuccess(t, rotate(t, b, config))
+	})
+
+	t.Run("recoversWhenVerifyFails", func(t *testing.T) {
+		b, config, fake := testBackend(t)
+		root := testConfigureRoot(t, b, config, fake)
+
+		fake.Fail(http.MethodGet, "/user/tokens/verify", http.StatusInternalServerError, false)
+		resp := rotate(t, b, config)
+		assert.Equal(t, map[string]interface{}{
+			"error": fmt.Sprintf("rolled root token (%s) but failed to verify the new value. the rotation will be recovered on the next call to config/rotate-root. err: HTTP status 500: Injected failure (10000)", root.ID),
+		}, resp.Data)
+		assert.Equal(t, root.Value, configuredToken(t, b, config), "unverified value must not be persisted")
+		assert.True(t, pendingRotationExists(t, config))
+
+		rolled, _ := fake.Token(root.ID)
+		testRequireSuccess(t, rotate(t, b, config))
+		assert.False(t, pendingRotationExists(t, config))
+
+		current, _ := fake.Token(root.ID)
+		assert.NotEqual(t, rolled.Value, current.Value)
+		assert.Equal(t, current.Value, configuredToken(t, b, config))
+	})
+
+	t.Run("errorsWhenRolledValueIsLost", func(t *testing.T) {
+		b, config, fake := testBackend(t)
+		root := testConfigureRoot(t, b, config, fake)
+
+		fake.Fail(http.MethodPut, "/user/tokens/"+root.ID+"/value", http.StatusInternalServerError, true)
+		resp := rotate(t, b, config)
+		assert.Equal(t, map[string]interface{}{
+			"error": fmt.Sprintf("failed to roll root token (%s) and the existing token can no longer be verified. the rotation will be recovered on the next call to config/rotate-root. err: HTTP status 500: Injected failure (10000)", root.ID),
+		}, resp.Data)
+
+		resp = rotate(t, b, config)
+		assert.True(t, resp.IsError())
+		assert.Contains(t, resp.Data["error"], "could not be recovered and the configured token is no longer valid")
+	})
+}
+
+func TestBackend_rotate_root_concurrent(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy}))
+
+	const workers = 8
+	const iterations = 10
+	const rotations = 10
+
+	errs := make(chan error, workers*iterations+rotations)
+	var wg sync.WaitGroup
+
+	// each worker issues, renews and revokes credentials, all of which use the
+	// root token, while the root token is rotated underneath them
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				resp, err := b.HandleRequest(context.Background(), &logical.Request{
+					Operation: logical.ReadOperation,
+					Path:      "creds/test",
+					Storage:   config.StorageView,
+				})
+				if err != nil || (resp != nil && resp.IsError()) {
+					errs <- fmt.Errorf("creds: resp:%#v err:%v", resp, err)
+					continue
+				}
+
+				secret := resp.Secret
+				secret.IssueTime = time.Now()
+				renewReq := logical.RenewRequest("creds/test", secret, nil)
+				renewReq.Storage = config.StorageView
+				resp, err = b.HandleRequest(context.Background(), renewReq)
+				if err != nil || (resp != nil && resp.IsError()) {
+					errs <- fmt.Errorf("renew: resp:%#v err:%v", resp, err)
+				}
+
+				revokeReq := logical.RevokeRequest("creds/test", secret, nil)
+				revokeReq.Storage = config.StorageView
+				resp, err = b.HandleRequest(context.Background(), revokeReq)
+				if err != nil || (resp != nil && resp.IsError()) {
+					errs <- fmt.Errorf("revoke: resp:%#v err:%v", resp, err)
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rotations; i++ {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "config/rotate-root",
+				Storage:   config.StorageView,
+			})
+			if err != nil || (resp != nil && resp.IsError()) {
+				errs <- fmt.Errorf("rotate-root: resp:%#v err:%v", resp, err)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// every issued token was revoked, leaving only the root token behind
+	assert.Len(t, fake.Tokens(), 1)
+}
+
+const synaticallyValidPolicy = `[
+	{
+		"effect": "allow",
+		"resources": {
+			"com.cloudflare.api.account.zone.eb78d65290b24279ba6f44721b3ea3c4": "*",
+			"com.cloudflare.api.account.zone.22b1de5f1c0e4b3ea97bb1e963b06a43": "*"
+		},
+		"permission_groups": [
+			{
+				"id": "c8fed203ed3043cba015a93ad1616f1f",
+				"name": "Zone Read"
+			},
+			{
+				"id": "82e64a83756745bbbb1c9c2701bf816b",
+				"name": "DNS Read"
+			}
+		]
+	}
+]`
+
+func TestBackend_roles(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	compactedValidPolicy, err := compactJSON(synaticallyValidPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultTTL := int64(config.System.DefaultLeaseTTL().Seconds())
+	maxTTL := int64(config.System.MaxLeaseTTL().Seconds())
+
+	testCases := []struct {
+		name                  string
+		policy                map[string]interface{}
+		expectedWriteResponse map[string]interface{}
+		expectedReadResponse  map[string]interface{}
+	}{
+		{
+			"succeedsWithNilPolicyDocument",
+			nil,
+			map[string]interface{}{"policy_document": "", "ttl": int64(0), "max_ttl": int64(0)},
+			nil,
+		},
+		{
+			"succeedsWithMissingPolicyDocument",
+			map[string]interface{}{"policy_document": ""},
+			map[string]interface{}{"policy_document": "", "ttl": int64(0), "max_ttl": int64(0)},
+			nil,
+		},
+		{
+			"succeedsWithInvalidJSONPolicyDocument",
+			map[string]interface{}{"policy_document": "{'}"},
+			map[string]interface{}{"error": "cannot parse policy document: \"{'}\""},
+			nil,
+		},
+		{
+			"errorsWhenJSONIsntList",
+			map[string]interface{}{"policy_document": "{}"},
+			map[string]interface{}{"error": "invalid policy document: $: must be a list of policies"},
+			nil,
+		},
+		{
+			"errorsWithUnknownFields",
+			map[string]interface{}{"policy_document": `[{"test": "test"}]`},
+			map[string]interface{}{"error": "invalid policy document: $[0].test: unknown field; $[0].effect: is required; $[0].resources: is required; $[0].permission_groups: is required"},
+			nil,
+		},
+		{
+			"errorsWithInvalidPolicies",
+			map[string]interface{}{"policy_document": `[
+				{"effect":"allow","resources":{"com.cloudflare.api.account.zone.a1e23bc2933e158857087ff3310c4e40":"*"},"permission_groups":[{"id":"4755a26eedb94da69e1066d98aa820be"}]},
+				{"effect":"permit","resources":{"*":"*","com.cloudflare.api.account.zone.a.b":"*","com.cloudflare.api.account.0d37909e38d3e99c29fa2cd343ac421a":{"com.cloudflare.api.account.zone.*":"read"}},"permission_groups":[{"id":"doesnotexist","nmae":"DNS Write"},{}]}
+			]`},
+			map[string]interface{}{"error": "invalid policy document: " +
+				"$[1].effect: must be one of 'allow' or 'deny'; " +
+				`$[1].resources["*"]: must start with one of 'com.cloudflare.api.account.', 'com.cloudflare.api.account.zone.' or 'com.cloudflare.api.user.'; ` +
+				`$[1].resources["com.cloudflare.api.account.0d37909e38d3e99c29fa2cd343ac421a"]["com.cloudflare.api.account.zone.*"]: must be "*"; ` +
+				`$[1].resources["com.cloudflare.api.account.zone.a.b"]: must end in an ID or '*'; ` +
+				"$[1].permission_groups[0].nmae: unknown field; " +
+				`$[1].permission_groups[0].id: unknown permission group "doesnotexist"; ` +
+				"$[1].permission_groups[1].id: is required"},
+			nil,
+		},
+		{
+			"succeedsWithValidPolicyDocument",
+			map[string]interface{}{"policy_document": synaticallyValidPolicy},
+			map[string]interface{}{"policy_document": compactedValidPolicy, "ttl": int64(0), "max_ttl": int64(0)},
+			map[string]interface{}{"policy_document": compactedValidPolicy, "ttl": int64(0), "max_ttl": int64(0), "effective_ttl": defaultTTL, "effective_max_ttl": maxTTL},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			resp := testRequest(t, b, config, logical.UpdateOperation, "roles/"+testCase.name, testCase.policy)
+			assert.Equal(t, testCase.expectedWriteResponse, resp.Data)
+
+			resp = testRequest(t, b, config, logical.ReadOperation, "roles/"+testCase.name, testCase.policy)
+
+			var respData map[string]interface{} = nil
+			if testCase.expectedReadResponse != nil {
+				respData = resp.Data
+			}
+			assert.Equal(t, testCase.expectedReadResponse, respData)
+		})
+	}
+}
+
+func TestBackend_roles_legacy_policy_document(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	// roles stored before policy documents were checked may hold documents
+	// that are rejected now
+	entry, err := logical.StorageEntryJSON("role/legacy", &cloudflareRoleEntry{PolicyDocument: `[{"test":"test"}]`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/legacy", map[string]interface{}{"ttl": "10m"}))
+	role, err := b.(*backend).roleRead(context.Background(), config.StorageView, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `[{"test":"test"}]`, role.PolicyDocument)
+	assert.Equal(t, 10*time.Minute, role.TTL)
+
+	// writing the document again checks it
+	resp := testRequest(t, b, config, logical.UpdateOperation, "roles/legacy", map[string]interface{}{"policy_document": `[{"test":"test"}]`})
+	assert.True(t, resp.IsError())
+	assert.Contains(t, resp.Data["error"], "invalid policy document")
+}
+
+func TestBackend_roles_ttl(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	resp := testRequest(t, b, config, logical.UpdateOperation, "roles/invalid", map[string]interface{}{"ttl": "2h", "max_ttl": "1h"})
+	assert.Equal(t, map[string]interface{}{"error": "ttl cannot be greater than max_ttl"}, resp.Data)
+
+	testRequest(t, b, config, logical.UpdateOperation, "config/lease", map[string]interface{}{"ttl": "1h", "max_ttl": "2h"})
+	testRequest(t, b, config, logical.UpdateOperation, "roles/lease", map[string]interface{}{"policy_document": validPolicy})
+	testRequest(t, b, config, logical.UpdateOperation, "roles/short", map[string]interface{}{"policy_document": validPolicy, "ttl": "10m", "max_ttl": "30m"})
+
+	data := testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "roles/lease", nil)).Data
+	assert.Equal(t, int64(0), data["ttl"])
+	assert.Equal(t, int64(3600), data["effective_ttl"])
+	assert.Equal(t, int64(7200), data["effective_max_ttl"])
+
+	data = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "roles/short", nil)).Data
+	assert.Equal(t, int64(600), data["ttl"])
+	assert.Equal(t, int64(1800), data["max_ttl"])
+	assert.Equal(t, int64(600), data["effective_ttl"])
+	assert.Equal(t, int64(1800), data["effective_max_ttl"])
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "creds/short", nil))
+	assert.Equal(t, 10*time.Minute, resp.Secret.TTL)
+	assert.Equal(t, 30*time.Minute, resp.Secret.MaxTTL)
+	issued, _ := fake.Token(resp.Data["id"].(string))
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), *issued.ExpiresOn, 5*time.Second)
+
+	secret := resp.Secret
+	secret.IssueTime = time.Now()
+	resp = testRequireSuccess(t, testHandleRequest(t, b, config, logical.RenewRequest("creds/short", secret, nil)))
+	assert.Equal(t, 10*time.Minute, resp.Secret.TTL)
+
+	// without config/lease the role falls back to the mount's tuning
+	testRequest(t, b, config, logical.DeleteOperation, "config/lease", nil)
+	data = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "roles/lease", nil)).Data
+	assert.Equal(t, int64(config.System.DefaultLeaseTTL().Seconds()), data["effective_ttl"])
+	assert.Equal(t, int64(config.System.MaxLeaseTTL().Seconds()), data["effective_max_ttl"])
+}
+
+func TestBackend_roles_structured(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+	zone := fake.AddZone("example.com", "0d37909e38d3e99c29fa2cd343ac421a")
+	fake.AddZone("duplicate.com", "0d37909e38d3e99c29fa2cd343ac421a")
+	fake.AddZone("duplicate.com", "b6bd1da5f1f4a3e2f17cb3ab2ddf0f8d")
+
+	errorCases := []struct {
+		name          string
+		data          map[string]interface{}
+		expectedError string
+	}{
+		{
+			"errorsWithPolicyDocument",
+			map[string]interface{}{"permission_groups": "DNS Write", "zones": "example.com", "policy_document": validPolicy},
+			"only one of 'policy_document' or 'permission_groups' may be set",
+		},
+		{
+			"errorsWithoutResources",
+			map[string]interface{}{"permission_groups": "DNS Write"},
+			"'permission_groups' requires at least one of 'zones' or 'account_ids'",
+		},
+		{
+			"errorsWithoutPermissionGroups",
+			map[string]interface{}{"zones": "example.com"},
+			"'zones' and 'account_ids' require 'permission_groups'",
+		},
+		{
+			"errorsWithInvalidEffect",
+			map[string]interface{}{"permission_groups": "DNS Write", "zones": "example.com", "effect": "maybe"},
+			"invalid effect \"maybe\". must be one of 'allow' or 'deny'",
+		},
+		{
+			"errorsWithUnknownPermissionGroup",
+			map[string]interface{}{"permission_groups": "DNS Write,Nope", "zones": "example.com"},
+			"failed to resolve 'permission_groups': unknown permission groups: Nope",
+		},
+		{
+			"errorsWithUnknownZone",
+			map[string]interface{}{"permission_groups": "DNS Write", "zones": "missing.com"},
+			"failed to resolve 'permission_groups': zone \"missing.com\" could not be found",
+		},
+		{
+			"errorsWithAmbiguousZone",
+			map[string]interface{}{"permission_groups": "DNS Write", "zones": "duplicate.com"},
+			"failed to resolve 'permission_groups': zone name \"duplicate.com\" is ambiguous. it matches 2 zones",
+		},
+	}
+	for _, testCase := range errorCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			resp := testRequest(t, b, config, logical.UpdateOperation, "roles/"+testCase.name, testCase.data)
+			assert.Equal(t, map[string]interface{}{"error": testCase.expectedError}, resp.Data)
+		})
+	}
+
+	resp := testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/structured", map[string]interface{}{
+		"permission_groups": "dns write,Zone Read",
+		"zones":             "example.com",
+		"account_ids":       "0d37909e38d3e99c29fa2cd343ac421a",
+	}))
+	assert.Equal(t, []interface{}{"dns write", "Zone Read"}, resp.Data["permission_groups"])
+
+	expectedPolicies := []cloudflare.APITokenPolicies{
+		{
+			Effect: "allow",
+			Resources: map[string]interface{}{
+				"com.cloudflare.api.account.zone." + zone.ID:                  "*",
+				"com.cloudflare.api.account.0d37909e38d3e99c29fa2cd343ac421a": "*",
+			},
+			PermissionGroups: []cloudflare.APITokenPermissionGroups{
+				{ID: "4755a26eedb94da69e1066d98aa820be", Name: "DNS Write"},
+				{ID: "c8fed203ed3043cba015a93ad1616f1f", Name: "Zone Read"},
+			},
+		},
+	}
+	role, err := b.(*backend).roleRead(context.Background(), config.StorageView, "structured")
 	if err != nil {
 		t.Fatal(err)
 	}
+	assert.Equal(t, expectedPolicies, role.Policies)
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "creds/structured", nil))
+	issued, _ := fake.Token(resp.Data["id"].(string))
+	assert.Equal(t, expectedPolicies, issued.Policies)
+
+	// writes that do not touch the structured fields keep the compiled
+	// policies instead of resolving them again
+	fake.Fail(http.MethodGet, "/zones", http.StatusInternalServerError, false)
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/structured", map[string]interface{}{"ttl": "10m"}))
+	role, err = b.(*backend).roleRead(context.Background(), config.StorageView, "structured")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedPolicies, role.Policies)
+	assert.Equal(t, 10*time.Minute, role.TTL)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "roles/structured", map[string]interface{}{"zones": "example.com"})
+	assert.Contains(t, resp.Data["error"], "failed to resolve 'permission_groups'")
+
+	// switching back to a policy document requires clearing the structured
+	// fields
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/structured", map[string]interface{}{"permission_groups": "", "zones": "", "account_ids": "", "policy_document": validPolicy}))
+	assert.NotContains(t, resp.Data, "policies")
+}
+
+func TestBackend_roles_validate(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	resp := testRequest(t, b, config, logical.UpdateOperation, "roles/missing/validate", nil)
+	assert.Equal(t, map[string]interface{}{"error": "could not find entry for role 'missing', did you configure it?"}, resp.Data)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "validate": true}))
+
+	tokens := len(fake.Tokens())
+	resp = testRequest(t, b, config, logical.UpdateOperation, "roles/test/validate", nil)
+	assert.Equal(t, map[string]interface{}{"valid": true}, resp.Data)
+	assert.Len(t, fake.Tokens(), tokens, "the validation token was not deleted")
+
+	// cloudflare stops accepting DNS Write, which the cached permission group
+	// catalog still lists
+	fake.SetPermissionGroups(fakecloudflare.DefaultPermissionGroups[:5])
+
+	expectedError := `role was rejected by cloudflare: $[0].permission_groups[0].id: invalid permission group "4755a26eedb94da69e1066d98aa820be" (1001)`
+	resp = testRequest(t, b, config, logical.UpdateOperation, "roles/test/validate", nil)
+	assert.Equal(t, map[string]interface{}{"error": expectedError}, resp.Data)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"ttl": "1h", "validate": true})
+	assert.Equal(t, map[string]interface{}{"error": expectedError}, resp.Data)
+	role, err := b.(*backend).roleRead(context.Background(), config.StorageView, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, role.TTL, "a role that failed validation was saved")
+
+	// without 'validate' the role is saved as before
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"ttl": "1h"}))
+	assert.Len(t, fake.Tokens(), tokens)
+}
+
+const validPolicy = `
+[{"effect":"allow","resources":{"com.cloudflare.api.account.zone.a1e23bc2933e158857087ff3310c4e40":"*"},"permission_groups":[{"id":"4755a26eedb94da69e1066d98aa820be","name":"DNS Write"}]}]
+`
+
+func TestBackend_permission_groups(t *testing.T) {
+	b, config, fake := testBackend(t)
+
+	resp := testRequest(t, b, config, logical.ReadOperation, "permission-groups", nil)
+	assert.Equal(t, "connection '' does not exist. did you configure 'config/token'?", resp.Data["error"])
+
+	testConfigureRoot(t, b, config, fake)
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "permission-groups", nil))
+	groups := resp.Data["permission_groups"].([]map[string]interface{})
+	assert.Len(t, groups, len(fakecloudflare.DefaultPermissionGroups))
+	assert.Equal(t, map[string]interface{}{
+		"id":     "4755a26eedb94da69e1066d98aa820be",
+		"name":   "DNS Write",
+		"scopes": []string{"com.cloudflare.api.account.zone"},
+	}, groups[5])
+	assert.NotEmpty(t, resp.Data["last_refreshed"])
+
+	// a new permission group is not picked up until the cache expires or is
+	// refreshed
+	added := cloudflare.APITokenPermissionGroups{ID: "3030687196b94b638145a3953da2b699", Name: "Workers Scripts Write", Scopes: []string{"com.cloudflare.api.account"}}
+	fake.SetPermissionGroups(append(fakecloudflare.DefaultPermissionGroups, added))
+
+	resp = testRequest(t, b, config, logical.ReadOperation, "permission-groups", nil)
+	assert.Len(t, resp.Data["permission_groups"], len(fakecloudflare.DefaultPermissionGroups))
+
+	resp = testRequest(t, b, config, logical.ReadOperation, "permission-groups", map[string]interface{}{"refresh": true})
+	assert.Len(t, resp.Data["permission_groups"], len(fakecloudflare.DefaultPermissionGroups)+1)
+
+	// roles resolve names against the cached catalog, refreshing it once if a
+	// name is unknown
+	fake.SetPermissionGroups(append(fakecloudflare.DefaultPermissionGroups,
+		added,
+		cloudflare.APITokenPermissionGroups{ID: "7cf72faf220841aabcfdfab81c43c4f6", Name: "Billing Read", Scopes: []string{"com.cloudflare.api.account"}},
+	))
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/billing", map[string]interface{}{"permission_groups": "Billing Read", "account_ids": "0d37909e38d3e99c29fa2cd343ac421a"}))
+	resp = testRequest(t, b, config, logical.ReadOperation, "permission-groups", nil)
+	assert.Len(t, resp.Data["permission_groups"], len(fakecloudflare.DefaultPermissionGroups)+2)
+
+	// an expired cache is fetched again
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"permission_groups_refresh_interval": "1s"}))
+	testRequest(t, b, config, logical.ReadOperation, "permission-groups", nil)
+	fake.SetPermissionGroups(fakecloudflare.DefaultPermissionGroups)
+	resp = testRequest(t, b, config, logical.ReadOperation, "permission-groups", nil)
+	assert.Len(t, resp.Data["permission_groups"], len(fakecloudflare.DefaultPermissionGroups)+2)
+	time.Sleep(time.Second)
+	resp = testRequest(t, b, config, logical.ReadOperation, "permission-groups", nil)
+	assert.Len(t, resp.Data["permission_groups"], len(fakecloudflare.DefaultPermissionGroups))
+}
+
+func TestBackend_creds_create(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
 
 	testCases := []struct {
 		name               string
@@ -343,89 +1290,1013 @@ func TestBackend_creds_create(t *testing.T) {
 			nil,
 			nil,
 		},
-		// TODO: add test for applying conditions to the api token
-		//       https://api.cloudflare.com/#user-api-tokens-create-token
-		// {
-		// 	"succeedsWithValidPolicyDocument",
-		// 	map[string]interface{}{"policy_document": validPolicy},
-		// 	nil,
-		// 	nil,
-		// },
+		{
+			"succeedsWithCondition",
+			map[string]interface{}{"policy_document": validPolicy},
+			map[string]interface{}{"condition": `{"request.ip":{"in":["192.0.2.0/24"]}}`},
+			nil,
+		},
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			confReq := &logical.Request{
-				Operation: logical.UpdateOperation,
-				Path:      "config/token",
-				Storage:   config.StorageView,
-				Data:      map[string]interface{}{"token": CLOUDFLARE_TOKEN},
-			}
-			resp, err := b.HandleRequest(context.Background(), confReq)
-			if err != nil {
-				t.Fatal(err)
+			testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/"+testCase.name, testCase.rolesData))
+
+			resp := testRequest(t, b, config, logical.ReadOperation, "creds/"+testCase.name, testCase.credsData)
+			if resp == nil {
+				t.Fatalf("'creds/%s' did not return a response", testCase.name)
 			}
 
-			c, err := b.(*backend).client(context.TODO(), config.StorageView)
-			if err != nil {
-				t.Fatal(err)
+			if testCase.expectedCredsError != nil {
+				assert.Equal(t, testCase.expectedCredsError, resp.Data)
+				return
 			}
 
-			confReq = &logical.Request{
-				Operation: logical.UpdateOperation,
-				Path:      fmt.Sprintf("roles/%s", testCase.name),
-				Storage:   config.StorageView,
-				Data:      testCase.rolesData,
+			tokenID := resp.Data["id"].(string)
+			createdToken, ok := fake.Token(tokenID)
+			if !ok {
+				t.Fatalf("token '%s' was not created", tokenID)
 			}
-			resp, err = b.HandleRequest(context.Background(), confReq)
-			if err != nil {
+			assert.Equal(t, resp.Data["token"], createdToken.Value)
+
+			var expectedPolicies []cloudflare.APITokenPolicies
+			if err := json.Unmarshal([]byte(testCase.rolesData["policy_document"].(string)), &expectedPolicies); err != nil {
 				t.Fatal(err)
 			}
+			assert.Equal(t, expectedPolicies, createdToken.Policies)
 
-			confReq = &logical.Request{
-				Operation: logical.ReadOperation,
-				Path:      fmt.Sprintf("creds/%s", testCase.name),
-				Storage:   config.StorageView,
-				Data:      testCase.credsData,
+			if condition, ok := testCase.credsData["condition"]; ok {
+				var expectedCondition cloudflare.APITokenCondition
+				if err := json.Unmarshal([]byte(condition.(string)), &expectedCondition); err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, &expectedCondition, createdToken.Condition)
+			}
+		})
+	}
+
+	// permission groups removed by cloudflare after the role was written are
+	// only noticed when the token is created
+	fake.SetPermissionGroups(fakecloudflare.DefaultPermissionGroups[:5])
+	resp := testRequest(t, b, config, logical.ReadOperation, "creds/succeedsWithValidPolicyDocument", nil)
+	assert.Equal(t, map[string]interface{}{"error": "failed to create token. err: HTTP status 400: invalid permission group \"4755a26eedb94da69e1066d98aa820be\" (1001)"}, resp.Data)
+}
+
+// failingPutStorage fails every write to a key under prefix.
+type failingPutStorage struct {
+	logical.Storage
+	prefix string
+}
+
+func (s *failingPutStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		return fmt.Errorf("failed to write %s", entry.Key)
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestBackend_creds_index_failure(t *testing.T) {
+	b, config, fake := testBackend(t)
+	root := testConfigureRoot(t, b, config, fake)
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy}))
+
+	// a token that cannot be indexed is deleted instead of handed out
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test",
+		Storage:   &failingPutStorage{Storage: config.StorageView, prefix: tokenPrefix},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to index token")
+
+	tokens := fake.Tokens()
+	if assert.Len(t, tokens, 1) {
+		assert.Equal(t, root.ID, tokens[0].ID)
+	}
+}
+
+func TestBackend_creds_ttl(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "ttl": "30m", "max_ttl": "1h"}))
+
+	testCases := []struct {
+		name             string
+		ttl              interface{}
+		expectedTTL      time.Duration
+		expectedWarnings []string
+	}{
+		{"usesRoleTTL", nil, 30 * time.Minute, nil},
+		{"usesRequestedTTL", "5m", 5 * time.Minute, nil},
+		{"clampsToMaxTTL", "3h", time.Hour, []string{"requested ttl of 3h0m0s exceeds the max_ttl. the token was issued with a ttl of 1h0m0s"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			data := map[string]interface{}{}
+			if testCase.ttl != nil {
+				data["ttl"] = testCase.ttl
+			}
+			resp := testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "creds/test", data))
+			assert.Equal(t, testCase.expectedTTL, resp.Secret.TTL)
+			assert.Equal(t, testCase.expectedWarnings, resp.Warnings)
+			issued, _ := fake.Token(resp.Data["id"].(string))
+			assert.WithinDuration(t, time.Now().Add(testCase.expectedTTL), *issued.ExpiresOn, 5*time.Second)
+		})
+	}
+}
+
+func TestBackend_creds_conditions(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	resp := testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "request_ip_in": "10.0.0.0/8,nope"})
+	assert.Equal(t, map[string]interface{}{"error": "invalid 'request_ip_in': invalid CIDR \"nope\""}, resp.Data)
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{
+		"policy_document":   validPolicy,
+		"request_ip_in":     "10.0.0.0/8,192.0.2.7/24",
+		"request_ip_not_in": "10.1.0.0/16",
+	}))
+	assert.Equal(t, []interface{}{"10.0.0.0/8", "192.0.2.0/24"}, resp.Data["request_ip_in"])
+	assert.Equal(t, []interface{}{"10.1.0.0/16"}, resp.Data["request_ip_not_in"])
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "creds/test", map[string]interface{}{"condition": `{"request.ip":{"in":["10.2.0.0/16"]}}`}))
+	token, _ := fake.Token(resp.Data["id"].(string))
+	assert.Equal(t, &cloudflare.APITokenCondition{RequestIP: &cloudflare.APITokenRequestIPCondition{
+		In:    []string{"10.2.0.0/16"},
+		NotIn: []string{"10.1.0.0/16"},
+	}}, token.Condition)
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "creds/test", map[string]interface{}{"condition": `{"request.ip":{"in":["10.0.0.0/7"]}}`})
+	assert.Equal(t, map[string]interface{}{"error": "'condition' may only narrow the condition of role 'test': 10.0.0.0/7 is not within the ranges allowed by the role (10.0.0.0/8, 192.0.2.0/24)"}, resp.Data)
+}
+
+func TestBackend_narrow_condition(t *testing.T) {
+	ipCondition := func(in, notIn []string) cloudflare.APITokenCondition {
+		return cloudflare.APITokenCondition{RequestIP: &cloudflare.APITokenRequestIPCondition{In: in, NotIn: notIn}}
+	}
+	role := &cloudflareRoleEntry{
+		RequestIPIn:    []string{"10.0.0.0/8", "192.0.2.0/24"},
+		RequestIPNotIn: []string{"10.1.0.0/16"},
+	}
+
+	testCases := []struct {
+		name              string
+		role              *cloudflareRoleEntry
+		requested         cloudflare.APITokenCondition
+		expectedCondition cloudflare.APITokenCondition
+		expectedError     string
+	}{
+		{
+			"passesThroughWithoutRoleRanges",
+			&cloudflareRoleEntry{},
+			ipCondition([]string{"2001:db8::/32"}, nil),
+			ipCondition([]string{"2001:db8::/32"}, nil),
+			"",
+		},
+		{
+			"usesRoleConditionByDefault",
+			role,
+			cloudflare.APITokenCondition{},
+			ipCondition([]string{"10.0.0.0/8", "192.0.2.0/24"}, []string{"10.1.0.0/16"}),
+			"",
+		},
+		{
+			"narrowsRoleCondition",
+			role,
+			ipCondition([]string{"10.2.0.0/16", "192.0.2.128/25"}, []string{"10.2.3.0/24"}),
+			ipCondition([]string{"10.2.0.0/16", "192.0.2.128/25"}, []string{"10.1.0.0/16", "10.2.3.0/24"}),
+			"",
+		},
+		{
+			"normalizesRanges",
+			role,
+			ipCondition([]string{"10.2.3.4", "10.2.0.0/16", "10.2.3.0/24", "192.0.2.9/30"}, nil),
+			ipCondition([]string{"10.2.0.0/16", "192.0.2.8/30"}, []string{"10.1.0.0/16"}),
+			"",
+		},
+		{
+			"keepsExclusionsOfRoleWithoutIn",
+			&cloudflareRoleEntry{RequestIPNotIn: []string{"10.1.0.0/16"}},
+			ipCondition([]string{"2001:db8::/32"}, nil),
+			ipCondition([]string{"2001:db8::/32"}, []string{"10.1.0.0/16"}),
+			"",
+		},
+		{
+			"acceptsRoleRangeItself",
+			role,
+			ipCondition([]string{"10.0.0.0/8"}, nil),
+			ipCondition([]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}),
+			"",
+		},
+		{
+			"errorsWhenWidened",
+			role,
+			ipCondition([]string{"10.0.0.0/7"}, nil),
+			cloudflare.APITokenCondition{},
+			"10.0.0.0/7 is not within the ranges allowed by the role (10.0.0.0/8, 192.0.2.0/24)",
+		},
+		{
+			"errorsWhenStraddlingRanges",
+			role,
+			ipCondition([]string{"192.0.2.0/23"}, nil),
+			cloudflare.APITokenCondition{},
+			"192.0.2.0/23 is not within the ranges allowed by the role (10.0.0.0/8, 192.0.2.0/24)",
+		},
+		{
+			"errorsWithOtherFamily",
+			role,
+			ipCondition([]string{"2001:db8::/32"}, nil),
+			cloudflare.APITokenCondition{},
+			"2001:db8::/32 is not within the ranges allowed by the role (10.0.0.0/8, 192.0.2.0/24)",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			condition, err := testCase.role.narrowCondition(testCase.requested)
+			if testCase.expectedError != "" {
+				assert.EqualError(t, err, testCase.expectedError)
+				return
 			}
-			resp, err = b.HandleRequest(context.Background(), confReq)
 			if err != nil {
 				t.Fatal(err)
 			}
+			assert.Equal(t, testCase.expectedCondition, condition)
+		})
+	}
+}
 
-			if resp == nil {
-				t.Fatalf("'creds/%s' did not return a response", testCase.name)
+func TestBackend_creds_condition_parsing(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy}))
+
+	testCases := []struct {
+		name              string
+		data              map[string]interface{}
+		expectedCondition *cloudflare.APITokenCondition
+		expectedError     string
+	}{
+		{
+			"succeedsWithIPv6",
+			map[string]interface{}{"condition": `{"request.ip":{"in":["2001:db8::1","2001:DB8::/32"],"not_in":["2001:db8:1::/48"]}}`},
+			&cloudflare.APITokenCondition{RequestIP: &cloudflare.APITokenRequestIPCondition{In: []string{"2001:db8::/32"}, NotIn: []string{"2001:db8:1::/48"}}},
+			"",
+		},
+		{
+			"succeedsWithEmptyCondition",
+			map[string]interface{}{"condition": `{"request.ip":{"in":[]}}`},
+			&cloudflare.APITokenCondition{},
+			"",
+		},
+		{
+			"succeedsWithListParameters",
+			map[string]interface{}{"request_ip_in": "192.0.2.0/24,198.51.100.7", "request_ip_not_in": "192.0.2.128/25"},
+			&cloudflare.APITokenCondition{RequestIP: &cloudflare.APITokenRequestIPCondition{In: []string{"192.0.2.0/24", "198.51.100.7/32"}, NotIn: []string{"192.0.2.128/25"}}},
+			"",
+		},
+		{
+			"errorsWithUnknownKey",
+			map[string]interface{}{"condition": `{"request.ip":{"in":["192.0.2.0/24"],"nin":["192.0.2.1"]}}`},
+			nil,
+			"err while decoding 'condition'. err: json: unknown field \"nin\"",
+		},
+		{
+			"errorsWithUnknownCondition",
+			map[string]interface{}{"condition": `{"request.time":{}}`},
+			nil,
+			"err while decoding 'condition'. err: json: unknown field \"request.time\"",
+		},
+		{
+			"errorsWithInvalidCIDR",
+			map[string]interface{}{"condition": `{"request.ip":{"not_in":["192.0.2.0/33"]}}`},
+			nil,
+			"err while decoding 'condition'. err: request.ip.not_in: invalid CIDR \"192.0.2.0/33\"",
+		},
+		{
+			"errorsWithInvalidListParameter",
+			map[string]interface{}{"request_ip_in": "example.com"},
+			nil,
+			"invalid IP ranges. err: request.ip.in: invalid CIDR \"example.com\"",
+		},
+		{
+			"errorsWithBothForms",
+			map[string]interface{}{"condition": `{"request.ip":{"in":["192.0.2.0/24"]}}`, "request_ip_in": "192.0.2.0/24"},
+			nil,
+			"only one of 'condition' or 'request_ip_in' and 'request_ip_not_in' may be set",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			resp := testRequest(t, b, config, logical.UpdateOperation, "creds/test", testCase.data)
+			if testCase.expectedError != "" {
+				assert.Equal(t, map[string]interface{}{"error": testCase.expectedError}, resp.Data)
+				return
 			}
+			if resp.IsError() {
+				t.Fatalf("failed to create creds: resp:%#v", resp)
+			}
+
+			token, _ := fake.Token(resp.Data["id"].(string))
+			assert.Equal(t, testCase.expectedCondition, token.Condition)
+		})
+	}
+}
 
-			// Prevents the token from leaking if we expected an error, but the token
-			// was created anyway
-			tokenID, ok := resp.Data["id"].(string)
-			if ok {
-				defer func() {
-					err := c.DeleteAPIToken(context.TODO(), tokenID)
-					if err != nil {
-						t.Fatalf("failed to delete token '%s'. be sure it deleted in cloudflare", tokenID)
-					}
-				}()
+func TestBackend_normalize_cidrs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cidrs    []string
+		expected []string
+	}{
+		{"empty", nil, nil},
+		{"singleAddresses", []string{"192.0.2.7", "2001:db8::1"}, []string{"192.0.2.7/32", "2001:db8::1/128"}},
+		{"masksHostBits", []string{"192.0.2.7/24"}, []string{"192.0.2.0/24"}},
+		{"sortsIPv4BeforeIPv6", []string{"2001:db8::/32", "198.51.100.0/24", "192.0.2.0/24"}, []string{"192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32"}},
+		{"dropsContainedRanges", []string{"10.2.3.0/24", "10.2.3.4", "10.0.0.0/8"}, []string{"10.0.0.0/8"}},
+		{"dropsDuplicates", []string{"192.0.2.0/24", "192.0.2.0/24"}, []string{"192.0.2.0/24"}},
+		{"keepsAdjacentRanges", []string{"192.0.2.128/25", "192.0.2.0/25"}, []string{"192.0.2.0/25", "192.0.2.128/25"}},
+		{"keepsFamiliesApart", []string{"::/0", "192.0.2.0/24"}, []string{"192.0.2.0/24", "::/0"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			networks, err := parseCIDRs(testCase.cidrs)
+			if err != nil {
+				t.Fatal(err)
 			}
+			assert.Equal(t, testCase.expected, formatCIDRs(networks))
+		})
+	}
+}
 
-			if testCase.expectedCredsError != nil {
-				assert.Equal(t, testCase.expectedCredsError, resp.Data)
+func TestBackend_creds_client_ip(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	resp := testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "bind_to_client_ip": true, "client_ipv4_prefix_length": 33})
+	assert.Equal(t, map[string]interface{}{"error": "'client_ipv4_prefix_length' must be between 1 and 32"}, resp.Data)
+	// 0 would be stored as unset and widen nothing, so it is rejected
+	resp = testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "bind_to_client_ip": true, "client_ipv4_prefix_length": 0})
+	assert.Equal(t, map[string]interface{}{"error": "'client_ipv4_prefix_length' must be between 1 and 32"}, resp.Data)
+	resp = testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "bind_to_client_ip": true, "client_ipv6_prefix_length": 0})
+	assert.Equal(t, map[string]interface{}{"error": "'client_ipv6_prefix_length' must be between 1 and 128"}, resp.Data)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{
+		"policy_document":           validPolicy,
+		"bind_to_client_ip":         true,
+		"client_ipv4_prefix_length": 28,
+		"client_ipv6_prefix_length": 64,
+		"request_ip_in":             "192.0.2.0/24,2001:db8::/32",
+		"request_ip_not_in":         "192.0.2.64/26",
+	}))
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "roles/test", nil))
+	assert.Equal(t, float64(28), resp.Data["client_ipv4_prefix_length"])
+	assert.Equal(t, float64(64), resp.Data["client_ipv6_prefix_length"])
+
+	testCases := []struct {
+		name              string
+		remoteAddr        string
+		condition         string
+		expectedCondition *cloudflare.APITokenCondition
+		expectedError     string
+	}{
+		{
+			"bindsIPv4Client",
+			"192.0.2.10",
+			"",
+			&cloudflare.APITokenCondition{RequestIP: &cloudflare.APITokenRequestIPCondition{In: []string{"192.0.2.0/28"}, NotIn: []string{"192.0.2.64/26"}}},
+			"",
+		},
+		{
+			"bindsIPv6ClientWithPort",
+			"[2001:db8:0:1::5]:8200",
+			"",
+			&cloudflare.APITokenCondition{RequestIP: &cloudflare.APITokenRequestIPCondition{In: []string{"2001:db8:0:1::/64"}, NotIn: []string{"192.0.2.64/26"}}},
+			"",
+		},
+		{
+			"errorsWithoutClientAddress",
+			"",
+			"",
+			nil,
+			"role 'test' binds tokens to the client's IP but the client's address is unknown",
+		},
+		{
+			"errorsOutsideRoleRanges",
+			"198.51.100.1",
+			"",
+			nil,
+			"failed to bind token to the client's IP: client network 198.51.100.0/28 is not within the allowed ranges (192.0.2.0/24, 2001:db8::/32)",
+		},
+		{
+			"errorsOutsideRequestedRanges",
+			"192.0.2.10",
+			`{"request.ip":{"in":["192.0.2.128/25"]}}`,
+			nil,
+			"failed to bind token to the client's IP: client network 192.0.2.0/28 is not within the allowed ranges (192.0.2.128/25)",
+		},
+		{
+			"errorsInExcludedRange",
+			"192.0.2.70",
+			"",
+			nil,
+			"failed to bind token to the client's IP: client network 192.0.2.64/28 is within the excluded range 192.0.2.64/26",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "creds/test",
+				Data:      map[string]interface{}{"condition": testCase.condition},
+			}
+			if testCase.remoteAddr != "" {
+				req.Connection = &logical.Connection{RemoteAddr: testCase.remoteAddr}
+			}
+			resp := testHandleRequest(t, b, config, req)
+			if testCase.expectedError != "" {
+				assert.Equal(t, map[string]interface{}{"error": testCase.expectedError}, resp.Data)
 				return
 			}
+			if resp.IsError() {
+				t.Fatalf("failed to create creds: resp:%#v", resp)
+			}
 
-			createdToken, err := c.GetAPIToken(context.TODO(), tokenID)
-			if err != nil {
-				t.Fatalf("failed to get token '%s'. err: %s", tokenID, err)
+			token, _ := fake.Token(resp.Data["id"].(string))
+			assert.Equal(t, testCase.expectedCondition, token.Condition)
+		})
+	}
+}
+
+func TestBackend_creds_identity_templates(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+	system := config.System.(*logical.StaticSystemView)
+
+	resp := testRequest(t, b, config, logical.UpdateOperation, "roles/team", map[string]interface{}{"policy_document": `[{"effect":"allow","resources":{"com.cloudflare.api.account.zone.{{identity.entity.metadata.zone":"*"},"permission_groups":[{"id":"4755a26eedb94da69e1066d98aa820be"}]}]`})
+	assert.Equal(t, map[string]interface{}{"error": `invalid policy document: $[0].resources["com.cloudflare.api.account.zone.{{identity.entity.metadata.zone"]: invalid identity template: unbalanced templating characters`}, resp.Data)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/team", map[string]interface{}{"policy_document": `[{"effect":"allow","resources":{"com.cloudflare.api.account.zone.{{identity.entity.metadata.zone}}":"*"},"permission_groups":[{"id":"4755a26eedb94da69e1066d98aa820be","name":"DNS Write"}]}]`}))
+
+	testCases := []struct {
+		name          string
+		entity        *logical.Entity
+		expectedZone  string
+		expectedError string
+	}{
+		{
+			"rendersEntityMetadata",
+			&logical.Entity{ID: "entity-a", Metadata: map[string]string{"zone": "a1e23bc2933e158857087ff3310c4e40"}},
+			"a1e23bc2933e158857087ff3310c4e40",
+			"",
+		},
+		{
+			"errorsWithoutEntity",
+			nil,
+			"",
+			"failed to render the policies of role 'team': the policies use identity templates but the request has no identity entity",
+		},
+		{
+			"errorsWithMissingMetadata",
+			&logical.Entity{ID: "entity-a", Metadata: map[string]string{"team": "dns"}},
+			"",
+			`failed to render the policies of role 'team': failed to render "com.cloudflare.api.account.zone.{{identity.entity.metadata.zone}}": no value could be found for one of the template directives`,
+		},
+		{
+			"errorsWhenRenderingWildcard",
+			&logical.Entity{ID: "entity-a", Metadata: map[string]string{"zone": "*"}},
+			"",
+			`failed to render the policies of role 'team': rendering "com.cloudflare.api.account.zone.{{identity.entity.metadata.zone}}" produced a wildcard`,
+		},
+		{
+			"errorsWhenRenderingInvalidResource",
+			&logical.Entity{ID: "entity-a", Metadata: map[string]string{"zone": "a1e23bc2933e158857087ff3310c4e40.other"}},
+			"",
+			`failed to render the policies of role 'team': the rendered policies are invalid: $[0].resources["com.cloudflare.api.account.zone.a1e23bc2933e158857087ff3310c4e40.other"]: must end in an ID or '*'`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			system.EntityVal = testCase.entity
+			entityID := ""
+			if testCase.entity != nil {
+				entityID = testCase.entity.ID
 			}
 
-			var expectedPolicies []cloudflare.APITokenPolicies
-			err = json.Unmarshal([]byte(testCase.rolesData["policy_document"].(string)), &expectedPolicies)
-			if err != nil {
-				t.Fatal(err)
+			resp := testHandleRequest(t, b, config, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "creds/team",
+				EntityID:  entityID,
+			})
+			if testCase.expectedError != "" {
+				assert.Equal(t, map[string]interface{}{"error": testCase.expectedError}, resp.Data)
+				return
 			}
-			expectedPolicies[0].ID = createdToken.Policies[0].ID
-			assert.Equal(t, expectedPolicies, createdToken.Policies)
+			if resp.IsError() {
+				t.Fatalf("failed to create creds: resp:%#v", resp)
+			}
+
+			token, _ := fake.Token(resp.Data["id"].(string))
+			assert.Equal(t, map[string]interface{}{zoneResourcePrefix + testCase.expectedZone: "*"}, token.Policies[0].Resources)
+		})
+	}
+}
+
+func TestBackend_creds_name_template(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	request := func(operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		return testRequireSuccess(t, testHandleRequest(t, b, config, &logical.Request{
+			ID:          "8b2f3d34-5cb3-4c8c-a0a5-e6b3b8e2a8c1",
+			Operation:   operation,
+			Path:        path,
+			DisplayName: "token-ci",
+			EntityID:    "entity-a",
+			Data:        data,
+		}))
+	}
+	issuedName := func(role string) string {
+		resp := request(logical.ReadOperation, "creds/"+role, nil)
+		token, _ := fake.Token(resp.Data["id"].(string))
+		return token.Name
+	}
+
+	resp := request(logical.ReadOperation, "config/name-template", nil)
+	assert.Equal(t, defaultNameTemplate, resp.Data["name_template"])
+
+	request(logical.UpdateOperation, "roles/Deploy", map[string]interface{}{"policy_document": validPolicy})
+	assert.Regexp(t, `^vault-deploy-[0-9A-Za-z]{8}$`, issuedName("Deploy"))
+
+	request(logical.UpdateOperation, "config/name-template", map[string]interface{}{"name_template": "{{.DisplayName}}-{{.RoleName}}-{{.RandomSuffix}}"})
+	assert.Regexp(t, `^token-ci-Deploy-[0-9A-Za-z]{8}$`, issuedName("Deploy"))
+
+	request(logical.UpdateOperation, "roles/Deploy", map[string]interface{}{"name_template": "{{.EntityID}}/{{.RequestID}}/{{.RandomSuffix}}"})
+	assert.Regexp(t, `^entity-a/8b2f3d34-5cb3-4c8c-a0a5-e6b3b8e2a8c1/[0-9A-Za-z]{8}$`, issuedName("Deploy"))
+
+	// long role names are shortened in front of the random suffix
+	longRole := strings.Repeat("a", 150)
+	request(logical.UpdateOperation, "roles/"+longRole, map[string]interface{}{"policy_document": validPolicy, "name_template": "{{.RoleName}}-{{.RandomSuffix}}-x"})
+	name := issuedName(longRole)
+	assert.Len(t, name, maxTokenNameLength)
+	assert.Regexp(t, `^a+-[0-9A-Za-z]{8}-x$`, name)
+
+	for _, path := range []string{"roles/Deploy", "config/name-template"} {
+		resp := testRequest(t, b, config, logical.UpdateOperation, path, map[string]interface{}{"name_template": "{{.Unknown}}"})
+		assert.Contains(t, resp.Data["error"], "invalid 'name_template': unable to apply template")
+
+		resp = testRequest(t, b, config, logical.UpdateOperation, path, map[string]interface{}{"name_template": "{{.RoleName}}-{{.RequestID}}"})
+		assert.Equal(t, map[string]interface{}{"error": "invalid 'name_template': template must include {{.RandomSuffix}} so token names are unique"}, resp.Data)
+	}
+}
+
+func TestBackend_truncate_token_name(t *testing.T) {
+	const suffix = "AbCd1234"
+	p := randomSuffixPlaceholder
+
+	testCases := []struct {
+		name     string
+		rendered string
+		expected string
+	}{
+		{"short", "vault-role-" + p, "vault-role-" + suffix},
+		{"exactLength", strings.Repeat("a", 111) + "-" + p, strings.Repeat("a", 111) + "-" + suffix},
+		{"shortensBeforeSuffix", strings.Repeat("a", 150) + "-" + p, strings.Repeat("a", 111) + "-" + suffix},
+		{"keepsTextAfterSuffix", strings.Repeat("a", 150) + "-" + p + "-x", strings.Repeat("a", 109) + "-" + suffix + "-x"},
+		{"shortensAfterSuffix", "a-" + p + "-" + strings.Repeat("b", 150), suffix + "-" + strings.Repeat("b", 111)},
+		{"suffixFirst", p + strings.Repeat("b", 150), suffix + strings.Repeat("b", 112)},
+		{"repeatedSuffix", strings.Repeat("a", 110) + "-" + p + "-" + p, strings.Repeat("a", 102) + "-" + suffix + "-" + suffix},
+		{"doesNotSplitCharacters", strings.Repeat("é", 60) + p, strings.Repeat("é", 56) + suffix},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			name := truncateTokenName(testCase.rendered, suffix)
+			assert.Equal(t, testCase.expected, name)
+			assert.LessOrEqual(t, len(name), maxTokenNameLength)
+			assert.Contains(t, name, suffix)
 		})
 	}
+
+	// templates that only include the suffix conditionally still get one
+	name, err := generateTokenName("{{if .EntityID}}{{.RandomSuffix}}-{{end}}vault", tokenNameData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Regexp(t, `^vault-[0-9A-Za-z]{8}$`, name)
+}
+
+func TestBackend_creds_renew_revoke(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy}))
+
+	resp := testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "creds/test", nil))
+	tokenID := resp.Data["id"].(string)
+	issued, _ := fake.Token(tokenID)
+
+	secret := resp.Secret
+	secret.IssueTime = issued.IssuedOn.Add(-time.Hour)
+
+	testRequireSuccess(t, testHandleRequest(t, b, config, logical.RenewRequest("creds/test", secret, nil)))
+	renewed, _ := fake.Token(tokenID)
+	assert.True(t, renewed.ExpiresOn.After(*issued.ExpiresOn), "expected renew to push expires_on past %s, got %s", issued.ExpiresOn, renewed.ExpiresOn)
+	// updates replace the whole token, so renewing must send everything back
+	assert.Equal(t, issued.Name, renewed.Name)
+	assert.Equal(t, issued.Policies, renewed.Policies)
+	assert.Equal(t, issued.Condition, renewed.Condition)
+
+	revokeReq := logical.RevokeRequest("creds/test", secret, nil)
+	testRequireSuccess(t, testHandleRequest(t, b, config, revokeReq))
+	_, ok := fake.Token(tokenID)
+	assert.False(t, ok, "expected token '%s' to be deleted", tokenID)
+
+	// revoking an already deleted token is a no-op
+	testRequireSuccess(t, testHandleRequest(t, b, config, revokeReq))
+}
+
+// testLiveBackend returns a backend using the default cloudflare API along with
+// the root token in TEST_CLOUDFLARE_TOKEN and a client for it. Tests using it
+// are skipped unless the variable is set to a token with 'User:API
+// Tokens:Edit' permissions.
+func testLiveBackend(t *testing.T) (logical.Backend, *logical.BackendConfig, string, *tokenClient) {
+	t.Helper()
+
+	rootValue := os.Getenv("TEST_CLOUDFLARE_TOKEN")
+	if rootValue == "" {
+		t.Skip("TEST_CLOUDFLARE_TOKEN is not set")
+	}
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b, err := Factory(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := createClient(&rootTokenConfig{Token: rootValue})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, config, rootValue, client
+}
+
+// testIsNotFound reports whether err is a 404 from the cloudflare API.
+func testIsNotFound(err error) bool {
+	var responseError *cloudflare.APIRequestError
+	return errors.As(err, &responseError) && responseError.HTTPStatusCode() == http.StatusNotFound
+}
+
+// TestBackend_live configures the root token and issues, renews and revokes a
+// token against the real Cloudflare API, which catches the places where the
+// fake API is more lenient than the real one.
+func TestBackend_live(t *testing.T) {
+	b, config, rootValue, client := testLiveBackend(t)
+
+	verified, err := client.VerifyAPIToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := client.GetAPIToken(context.Background(), verified.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// grant the issued token a harmless permission on the user that owns the
+	// root token
+	var userResource string
+	for _, policy := range root.Policies {
+		for resource := range policy.Resources {
+			if strings.HasPrefix(resource, userResourcePrefix) {
+				userResource = resource
+			}
+		}
+	}
+	if userResource == "" {
+		t.Fatal("the root token does not grant any permissions on a user")
+	}
+	groups, err := client.ListAPITokensPermissionGroups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var userDetailsRead cloudflare.APITokenPermissionGroups
+	for _, group := range groups {
+		if group.Name == "User Details Read" {
+			userDetailsRead = group
+		}
+	}
+	if userDetailsRead.ID == "" {
+		t.Fatal("permission group 'User Details Read' does not exist")
+	}
+	policy, err := json.Marshal([]cloudflare.APITokenPolicies{{
+		Effect:           policyEffectAllow,
+		Resources:        map[string]interface{}{userResource: "*"},
+		PermissionGroups: []cloudflare.APITokenPermissionGroups{{ID: userDetailsRead.ID}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": rootValue}))
+	data := testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "config/token", nil)).Data
+	assert.Equal(t, root.ID, data["id"])
+	assert.Equal(t, maskToken(rootValue), data["masked_token"])
+	assert.Equal(t, root.Name, data["name"])
+
+	resp := testRequest(t, b, config, logical.UpdateOperation, "roles/invalid", map[string]interface{}{"policy_document": `[{"test":"test"}]`})
+	assert.True(t, resp.IsError(), "expected an invalid policy document to be rejected")
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/live", map[string]interface{}{"policy_document": string(policy), "ttl": "10m"}))
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "creds/live", nil))
+	tokenID := resp.Data["id"].(string)
+	t.Cleanup(func() {
+		if err := client.DeleteAPIToken(context.Background(), tokenID); err != nil && !testIsNotFound(err) {
+			t.Errorf("failed to delete token '%s'. please ensure it is deleted in cloudflare. err: %s", tokenID, err)
+		}
+	})
+	issued, err := client.GetAPIToken(context.Background(), tokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewReq := logical.RenewRequest("creds/live", resp.Secret, nil)
+	testRequireSuccess(t, testHandleRequest(t, b, config, renewReq))
+	renewed, err := client.GetAPIToken(context.Background(), tokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, issued.Name, renewed.Name)
+	assert.Equal(t, issued.Policies, renewed.Policies)
+	assert.NotNil(t, renewed.ExpiresOn)
+
+	revokeReq := logical.RevokeRequest("creds/live", resp.Secret, nil)
+	testRequireSuccess(t, testHandleRequest(t, b, config, revokeReq))
+	_, err = client.GetAPIToken(context.Background(), tokenID)
+	assert.True(t, testIsNotFound(err), "expected token '%s' to be deleted, got err: %v", tokenID, err)
+}
+
+// TestBackend_live_rotate_root rolls a token against the real Cloudflare API.
+// Cloudflare does not let the root token create a token that can manage
+// tokens, and rolling the root token itself would invalidate
+// TEST_CLOUDFLARE_TOKEN, so the configuration pairs the root token's value
+// with the ID of an empty token that is rolled in its place.
+func TestBackend_live_rotate_root(t *testing.T) {
+	b, config, rootValue, client := testLiveBackend(t)
+
+	expiresOn := time.Now().UTC().Truncate(time.Second).Add(30 * time.Minute)
+	empty, err := client.CreateAPIToken(context.Background(), cloudflare.APIToken{
+		Name:      fmt.Sprintf("vault-integration-test-rotate-root-%d", time.Now().UnixNano()),
+		ExpiresOn: &expiresOn,
+		Policies:  []cloudflare.APITokenPolicies{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := client.DeleteAPIToken(context.Background(), empty.ID); err != nil && !testIsNotFound(err) {
+			t.Errorf("failed to delete token '%s'. please ensure it is deleted in cloudflare. err: %s", empty.ID, err)
+		}
+	})
+
+	entry, err := logical.StorageEntryJSON(configTokenKey, &rootTokenConfig{TokenID: empty.ID, Token: rootValue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", nil))
+	assert.Equal(t, empty.ID, resp.Data["id"])
+
+	// the configured token is the new value of the rolled token
+	rotated, err := b.(*backend).client(context.Background(), config.StorageView, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := rotated.VerifyAPIToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "active", verified.Status)
+	assert.Equal(t, empty.ID, verified.ID)
+
+	// and the old value is rejected
+	old, err := createClient(&rootTokenConfig{Token: empty.Value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.VerifyAPIToken(context.Background())
+	assert.EqualError(t, err, "HTTP status 401: Invalid API Token (1000)")
+}
+
+func TestBackend_connections(t *testing.T) {
+	b, config, fake := testBackend(t)
+	root := testConfigureRoot(t, b, config, fake)
+	other := fake.RootToken()
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/connections/other", map[string]interface{}{"token": other.Value}))
+
+	resp := testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "config/connections/other", nil))
+	assert.Equal(t, other.ID, resp.Data["id"])
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ListOperation, "config/connections/", nil))
+	assert.Equal(t, []string{"other"}, resp.Data["keys"])
+
+	resp = testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "connection": "missing"})
+	assert.Equal(t, map[string]interface{}{"error": "connection 'missing' does not exist"}, resp.Data)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "connection": "other"}))
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "creds/test", nil))
+	assert.Equal(t, "Bearer "+other.Value, fake.LastRequestHeader().Get("Authorization"))
+	assert.Equal(t, "other", resp.Secret.InternalData["connection"])
+	tokenID := resp.Data["id"].(string)
+	secret := resp.Secret
+
+	// the connection cannot be deleted while a role uses it
+	resp = testRequest(t, b, config, logical.DeleteOperation, "config/connections/other", nil)
+	assert.Equal(t, map[string]interface{}{"error": "'config/connections/other' is still used by roles test. delete them or move them to another connection first"}, resp.Data)
+
+	// the lease keeps using the connection that issued it after the role is
+	// moved to another connection
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"connection": ""}))
+
+	// nor while it manages an outstanding lease
+	resp = testRequest(t, b, config, logical.DeleteOperation, "config/connections/other", nil)
+	assert.Equal(t, map[string]interface{}{"error": "'config/connections/other' still manages 1 issued tokens recorded in 'tokens/'. revoke their leases first"}, resp.Data)
+
+	testRequireSuccess(t, testHandleRequest(t, b, config, logical.RevokeRequest("creds/test", secret, nil)))
+	assert.Equal(t, "Bearer "+other.Value, fake.LastRequestHeader().Get("Authorization"))
+	_, ok := fake.Token(tokenID)
+	assert.False(t, ok, "expected token '%s' to be deleted", tokenID)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/connections/other/rotate-root", nil))
+	rotated, err := b.(*backend).readConnection(context.Background(), config.StorageView, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, other.Value, rotated.Token)
+	unchanged, err := b.(*backend).readConnection(context.Background(), config.StorageView, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, root.Value, unchanged.Token)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.DeleteOperation, "config/connections/other", nil))
+	_, err = b.(*backend).client(context.Background(), config.StorageView, "other")
+	assert.EqualError(t, err, "connection 'other' does not exist. did you configure 'config/connections/other'?")
+}
+
+func TestBackend_connections_delete(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+	other := fake.RootToken()
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/connections/other", map[string]interface{}{"token": other.Value}))
+
+	// a root token retired by the connection that is still in its grace
+	// period, and an interrupted rotation
+	retiredToken := fake.RootToken()
+	putEntry := func(key string, value interface{}) {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.StorageView.Put(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putEntry(retiredRootTokenPrefix+retiredToken.ID, &retiredRootToken{TokenID: retiredToken.ID, Connection: "other", DeleteAfter: time.Now().Add(time.Hour)})
+	putEntry(pendingRotationStorageKey("other"), &pendingRotation{TokenID: other.ID})
+
+	// a lease issued before the token index existed has no entry in tokens/
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/test", map[string]interface{}{"policy_document": validPolicy, "connection": "other"}))
+	resp := testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "creds/test", nil))
+	tokenID := resp.Data["id"].(string)
+	secret := resp.Secret
+	if err := config.StorageView.Delete(context.Background(), tokenPrefix+tokenID); err != nil {
+		t.Fatal(err)
+	}
+	testRequireSuccess(t, testRequest(t, b, config, logical.DeleteOperation, "roles/test", nil))
+
+	// only indexed tokens keep the connection from being deleted
+	assert.Nil(t, testRequest(t, b, config, logical.DeleteOperation, "config/connections/other", nil))
+
+	_, ok := fake.Token(retiredToken.ID)
+	assert.False(t, ok, "expected retired root token '%s' to be deleted with its connection", retiredToken.ID)
+	for _, prefix := range []string{retiredRootTokenPrefix, connectionPendingRotationPrefix} {
+		keys, err := config.StorageView.List(context.Background(), prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, keys, "expected nothing left under %s", prefix)
+	}
+
+	// so the unindexed lease can no longer be revoked
+	revokeReq := logical.RevokeRequest("creds/test", secret, nil)
+	revokeReq.Storage = config.StorageView
+	_, err := b.HandleRequest(context.Background(), revokeReq)
+	assert.EqualError(t, err, "connection 'other' does not exist. did you configure 'config/connections/other'?")
+	_, ok = fake.Token(tokenID)
+	assert.True(t, ok)
+}
+
+func TestBackend_account_tokens(t *testing.T) {
+	b, config, fake := testBackend(t)
+	root := fake.AccountRootToken("account-a")
+
+	// account-owned tokens cannot be verified through the user endpoints
+	resp := testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": root.Value})
+	assert.Equal(t, map[string]interface{}{"error": "encountered error when verifying token: HTTP status 400: Invalid API Token (1000)"}, resp.Data)
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/token", map[string]interface{}{"token": root.Value, "account_id": "account-a"}))
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/default", map[string]interface{}{"policy_document": validPolicy}))
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/other", map[string]interface{}{"policy_document": validPolicy, "account_id": "account-b"}))
+
+	for role, account := range map[string]string{"default": "account-a", "other": "account-b"} {
+		resp := testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "creds/"+role, nil))
+		tokenID := resp.Data["id"].(string)
+		assert.Equal(t, account, fake.TokenOwner(tokenID), "unexpected owner of token issued for role '%s'", role)
+		assert.Equal(t, account, resp.Secret.InternalData["account_id"])
+
+		secret := resp.Secret
+		secret.IssueTime = time.Now()
+		testRequireSuccess(t, testHandleRequest(t, b, config, logical.RenewRequest("creds/"+role, secret, nil)))
+		testRequireSuccess(t, testHandleRequest(t, b, config, logical.RevokeRequest("creds/"+role, secret, nil)))
+		_, ok := fake.Token(tokenID)
+		assert.False(t, ok, "expected token '%s' to be deleted", tokenID)
+	}
+
+	testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "config/rotate-root", nil))
+	rotated, _ := fake.Token(root.ID)
+	assert.NotEqual(t, root.Value, rotated.Value)
+	assert.Equal(t, "account-a", fake.TokenOwner(root.ID))
+}
+
+func TestBackend_tokens(t *testing.T) {
+	b, config, fake := testBackend(t)
+	testConfigureRoot(t, b, config, fake)
+
+	for _, role := range []string{"dns", "ci"} {
+		testRequireSuccess(t, testRequest(t, b, config, logical.UpdateOperation, "roles/"+role, map[string]interface{}{"policy_document": validPolicy}))
+	}
+
+	secrets := map[string]*logical.Secret{}
+	for _, role := range []string{"dns", "dns", "ci"} {
+		resp := testRequireSuccess(t, testHandleRequest(t, b, config, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + role,
+			EntityID:  "entity-a",
+		}))
+		secrets[resp.Data["id"].(string)] = resp.Secret
+	}
+
+	resp := testRequireSuccess(t, testRequest(t, b, config, logical.ListOperation, "tokens/", nil))
+	assert.Len(t, resp.Data["keys"], 3)
+
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ListOperation, "tokens/", map[string]interface{}{"role": "dns"}))
+	assert.Len(t, resp.Data["keys"], 2)
+	for _, id := range resp.Data["keys"].([]string) {
+		info := resp.Data["key_info"].(map[string]interface{})[id].(map[string]interface{})
+		assert.Equal(t, "dns", info["role"])
+	}
+
+	var ciID string
+	for id, secret := range secrets {
+		if secret.InternalData["role"] == "ci" {
+			ciID = id
+		}
+	}
+	issued, _ := fake.Token(ciID)
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "tokens/"+ciID, nil))
+	assert.Equal(t, ciID, resp.Data["id"])
+	assert.Equal(t, "ci", resp.Data["role"])
+	assert.Equal(t, issued.Name, resp.Data["name"])
+	assert.Equal(t, "entity-a", resp.Data["entity_id"])
+	assert.NotEmpty(t, resp.Data["issued_at"])
+	assert.Equal(t, issued.ExpiresOn.Format(time.RFC3339), resp.Data["expires_at"])
+
+	// renewals move the recorded expiry along with the token's
+	secret := secrets[ciID]
+	secret.IssueTime = time.Now()
+	testRequireSuccess(t, testHandleRequest(t, b, config, logical.RenewRequest("creds/ci", secret, nil)))
+	renewed, _ := fake.Token(ciID)
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ReadOperation, "tokens/"+ciID, nil))
+	assert.Equal(t, renewed.ExpiresOn.Format(time.RFC3339), resp.Data["expires_at"])
+
+	testRequireSuccess(t, testHandleRequest(t, b, config, logical.RevokeRequest("creds/ci", secret, nil)))
+	resp = testRequest(t, b, config, logical.ReadOperation, "tokens/"+ciID, nil)
+	assert.Nil(t, resp)
+	resp = testRequireSuccess(t, testRequest(t, b, config, logical.ListOperation, "tokens/", map[string]interface{}{"role": "ci"}))
+	assert.Empty(t, resp.Data["keys"])
 }
@@ -2,12 +2,22 @@ package cloudflare
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// defaultRequestTimeout is used for requests to the cloudflare API when
+// 'request_timeout' is not configured.
+const defaultRequestTimeout = 10 * time.Second
+
 type withHeader struct {
 	http.Header
 	rt http.RoundTripper
@@ -29,17 +39,107 @@ func (h withHeader) RoundTrip(req *http.Request) (*http.Response, error) {
 	return h.rt.RoundTrip(req)
 }
 
-func createClient(token string) (*cloudflare.API, error) {
-	// client := &http.Client{
-	// 	Timeout: time.Second * 10,
-	// }
-	return cloudflare.NewWithAPIToken(token)
+// createHTTPClient builds the http client used to talk to the cloudflare API
+// based on the transport settings in conf.
+func createHTTPClient(conf *rootTokenConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if conf.ProxyURL != "" {
+		proxyURL, err := url.Parse(conf.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if conf.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(conf.CACert)) {
+			return nil, fmt.Errorf("ca_cert does not contain any valid PEM encoded certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	rt := WithHeader(transport)
+	for k, v := range conf.Headers {
+		rt.Set(k, v)
+	}
+
+	timeout := conf.RequestTimeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+
+	return &http.Client{
+		Transport: rt,
+		Timeout:   timeout,
+	}, nil
+}
+
+// createClient builds a client authenticated with the root credential in conf
+// that manages tokens owned by its account_id, if set.
+func createClient(conf *rootTokenConfig, opts ...cloudflare.Option) (*tokenClient, error) {
+	httpClient, err := createHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	clientOpts := []cloudflare.Option{cloudflare.HTTPClient(httpClient)}
+	if conf.APIBaseURL != "" {
+		clientOpts = append(clientOpts, cloudflare.BaseURL(strings.TrimSuffix(conf.APIBaseURL, "/")))
+	}
+
+	var api *cloudflare.API
+	if conf.authType() == authTypeAPIKey {
+		api, err = cloudflare.New(conf.APIKey, conf.Email, append(clientOpts, opts...)...)
+	} else {
+		api, err = cloudflare.NewWithAPIToken(conf.Token, append(clientOpts, opts...)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenClient{API: api, accountID: conf.AccountID}, nil
 }
 
-func (b *backend) client(ctx context.Context, s logical.Storage) (*cloudflare.API, error) {
-	conf, err := b.readConfigToken(ctx, s)
+// client returns the cloudflare client of the named connection, creating and
+// caching it from storage if needed.
+func (b *backend) client(ctx context.Context, s logical.Storage, name string) (*tokenClient, error) {
+	b.clientMutex.RLock()
+	if client, ok := b.cachedClients[name]; ok {
+		defer b.clientMutex.RUnlock()
+		return client, nil
+	}
+	b.clientMutex.RUnlock()
+
+	b.clientMutex.Lock()
+	defer b.clientMutex.Unlock()
+
+	// another caller may have built the client while we were waiting on the
+	// write lock
+	if client, ok := b.cachedClients[name]; ok {
+		return client, nil
+	}
+
+	conf, err := b.readConnection(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		if name != "" {
+			return nil, fmt.Errorf("connection '%s' does not exist. did you configure '%s'?", name, connectionPath(name))
+		}
+		return nil, fmt.Errorf("configuration does not exist. did you configure 'config/token'?")
+	}
+
+	client, err := createClient(conf, b.clientOptions...)
 	if err != nil {
 		return nil, err
 	}
-	return createClient(conf.Token)
+	b.cachedClients[name] = client
+
+	return client, nil
 }
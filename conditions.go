@@ -0,0 +1,252 @@
+package cloudflare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// parseCIDRs parses each of cidrs, which may be IPv4 or IPv6 networks or
+// single addresses, and returns them normalized: ranges contained in another
+// are dropped and the rest are sorted.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", cidr)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			bits := len(ip) * 8
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return normalizeCIDRs(networks), nil
+}
+
+// normalizeCIDRs drops the networks contained in another and sorts the rest,
+// IPv4 before IPv6.
+func normalizeCIDRs(networks []*net.IPNet) []*net.IPNet {
+	sorted := make([]*net.IPNet, len(networks))
+	copy(sorted, networks)
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i].IP) != len(sorted[j].IP) {
+			return len(sorted[i].IP) < len(sorted[j].IP)
+		}
+		if c := bytes.Compare(sorted[i].IP, sorted[j].IP); c != 0 {
+			return c < 0
+		}
+		iOnes, _ := sorted[i].Mask.Size()
+		jOnes, _ := sorted[j].Mask.Size()
+		return iOnes < jOnes
+	})
+
+	// a network can only be contained in one sorted before it, and if it is
+	// contained in any of them it is contained in the last one kept
+	var normalized []*net.IPNet
+	for _, network := range sorted {
+		if len(normalized) > 0 && cidrContains(normalized[len(normalized)-1], network) {
+			continue
+		}
+		normalized = append(normalized, network)
+	}
+	return normalized
+}
+
+func formatCIDRs(networks []*net.IPNet) []string {
+	var cidrs []string
+	for _, network := range networks {
+		cidrs = append(cidrs, network.String())
+	}
+	return cidrs
+}
+
+// parseCondition strictly parses a JSON-encoded cloudflare token condition.
+// Unknown keys are rejected and the IP ranges are validated and normalized.
+func parseCondition(raw string) (cloudflare.APITokenCondition, error) {
+	var condition struct {
+		RequestIP *struct {
+			In    []string `json:"in"`
+			NotIn []string `json:"not_in"`
+		} `json:"request.ip"`
+	}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&condition); err != nil {
+		return cloudflare.APITokenCondition{}, err
+	}
+	if decoder.More() {
+		return cloudflare.APITokenCondition{}, fmt.Errorf("unexpected data after the condition")
+	}
+
+	if condition.RequestIP == nil {
+		return cloudflare.APITokenCondition{}, nil
+	}
+	return ipCondition(condition.RequestIP.In, condition.RequestIP.NotIn)
+}
+
+// ipCondition returns the condition allowing the ranges in and excluding the
+// ranges notIn, after validating and normalizing both.
+func ipCondition(in, notIn []string) (cloudflare.APITokenCondition, error) {
+	inNetworks, err := parseCIDRs(in)
+	if err != nil {
+		return cloudflare.APITokenCondition{}, fmt.Errorf("request.ip.in: %w", err)
+	}
+	notInNetworks, err := parseCIDRs(notIn)
+	if err != nil {
+		return cloudflare.APITokenCondition{}, fmt.Errorf("request.ip.not_in: %w", err)
+	}
+
+	if len(inNetworks) == 0 && len(notInNetworks) == 0 {
+		return cloudflare.APITokenCondition{}, nil
+	}
+	return cloudflare.APITokenCondition{
+		RequestIP: &cloudflare.APITokenRequestIPCondition{
+			In:    formatCIDRs(inNetworks),
+			NotIn: formatCIDRs(notInNetworks),
+		},
+	}, nil
+}
+
+// cidrContains reports whether every address in inner is also in outer.
+func cidrContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// narrowCondition combines the IP condition of role with the one requested by
+// a caller. Callers can only narrow the role's condition: every range they
+// allow must lie within one the role allows, and the ranges either of them
+// excludes are all excluded.
+func (r *cloudflareRoleEntry) narrowCondition(requested cloudflare.APITokenCondition) (cloudflare.APITokenCondition, error) {
+	if len(r.RequestIPIn) == 0 && len(r.RequestIPNotIn) == 0 {
+		return requested, nil
+	}
+
+	var requestedIn, requestedNotIn []string
+	if requested.RequestIP != nil {
+		requestedIn, requestedNotIn = requested.RequestIP.In, requested.RequestIP.NotIn
+	}
+
+	roleIn, err := parseCIDRs(r.RequestIPIn)
+	if err != nil {
+		return cloudflare.APITokenCondition{}, err
+	}
+	roleNotIn, err := parseCIDRs(r.RequestIPNotIn)
+	if err != nil {
+		return cloudflare.APITokenCondition{}, err
+	}
+	in, err := parseCIDRs(requestedIn)
+	if err != nil {
+		return cloudflare.APITokenCondition{}, err
+	}
+	notIn, err := parseCIDRs(requestedNotIn)
+	if err != nil {
+		return cloudflare.APITokenCondition{}, err
+	}
+
+	if len(in) == 0 {
+		in = roleIn
+	} else if len(roleIn) > 0 {
+		for _, network := range in {
+			if !containedInAny(roleIn, network) {
+				return cloudflare.APITokenCondition{}, fmt.Errorf("%s is not within the ranges allowed by the role (%s)", network, strings.Join(r.RequestIPIn, ", "))
+			}
+		}
+	}
+	notIn = normalizeCIDRs(append(notIn, roleNotIn...))
+
+	if len(in) == 0 && len(notIn) == 0 {
+		return cloudflare.APITokenCondition{}, nil
+	}
+	return cloudflare.APITokenCondition{
+		RequestIP: &cloudflare.APITokenRequestIPCondition{
+			In:    formatCIDRs(in),
+			NotIn: formatCIDRs(notIn),
+		},
+	}, nil
+}
+
+// clientNetwork returns the network of the given prefix length around the
+// client address remoteAddr, which may include a port. A prefix length of 0
+// selects the client address alone.
+func clientNetwork(remoteAddr string, ipv4PrefixLength, ipv6PrefixLength int) (*net.IPNet, error) {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address %q", remoteAddr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if ipv4PrefixLength == 0 {
+			ipv4PrefixLength = 32
+		}
+		mask := net.CIDRMask(ipv4PrefixLength, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}, nil
+	}
+	if ipv6PrefixLength == 0 {
+		ipv6PrefixLength = 128
+	}
+	mask := net.CIDRMask(ipv6PrefixLength, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// bindCondition limits condition to client. client must lie within one of the
+// ranges condition allows and must not be entirely excluded by it.
+func bindCondition(condition cloudflare.APITokenCondition, client *net.IPNet) (cloudflare.APITokenCondition, error) {
+	var in, notIn []*net.IPNet
+	if condition.RequestIP != nil {
+		var err error
+		if in, err = parseCIDRs(condition.RequestIP.In); err != nil {
+			return cloudflare.APITokenCondition{}, err
+		}
+		if notIn, err = parseCIDRs(condition.RequestIP.NotIn); err != nil {
+			return cloudflare.APITokenCondition{}, err
+		}
+	}
+
+	if len(in) > 0 && !containedInAny(in, client) {
+		return cloudflare.APITokenCondition{}, fmt.Errorf("client network %s is not within the allowed ranges (%s)", client, strings.Join(formatCIDRs(in), ", "))
+	}
+	for _, network := range notIn {
+		if cidrContains(network, client) {
+			return cloudflare.APITokenCondition{}, fmt.Errorf("client network %s is within the excluded range %s", client, network)
+		}
+	}
+
+	return cloudflare.APITokenCondition{
+		RequestIP: &cloudflare.APITokenRequestIPCondition{
+			In:    []string{client.String()},
+			NotIn: formatCIDRs(notIn),
+		},
+	}, nil
+}
+
+func containedInAny(networks []*net.IPNet, network *net.IPNet) bool {
+	for _, outer := range networks {
+		if cidrContains(outer, network) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,651 @@
+// Package fakecloudflare provides an in-memory stand-in for the parts of the
+// Cloudflare v4 API used by the plugin so the backend can be tested without
+// network access or a real Cloudflare account.
+package fakecloudflare
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// tokenValueLength is the length of the token values handed out by the fake.
+// Bearer tokens of any other length are rejected as malformed, mirroring the
+// real API.
+const tokenValueLength = 40
+
+// DefaultPermissionGroups is the permission group catalog served by a new
+// Server.
+var DefaultPermissionGroups = []cloudflare.APITokenPermissionGroups{
+	{ID: "686d18d5ac6c441c867cbf6771e58a0a", Name: "API Tokens Write", Scopes: []string{"com.cloudflare.api.user"}},
+	{ID: "0cc3a61731504c89b99ec1be78b77aa0", Name: "API Tokens Read", Scopes: []string{"com.cloudflare.api.user"}},
+	{ID: "c8fed203ed3043cba015a93ad1616f1f", Name: "Zone Read", Scopes: []string{"com.cloudflare.api.account.zone"}},
+	{ID: "e6d2666161e84845a636613608cee8d5", Name: "Zone Write", Scopes: []string{"com.cloudflare.api.account.zone"}},
+	{ID: "82e64a83756745bbbb1c9c2701bf816b", Name: "DNS Read", Scopes: []string{"com.cloudflare.api.account.zone"}},
+	{ID: "4755a26eedb94da69e1066d98aa820be", Name: "DNS Write", Scopes: []string{"com.cloudflare.api.account.zone"}},
+	{ID: "c1fde68c7bcc44588cbb6ddbc16d6480", Name: "Account Settings Read", Scopes: []string{"com.cloudflare.api.account"}},
+	{ID: "5bc3f8b21c554832afc660159ab75fa4", Name: "Account API Tokens Write", Scopes: []string{"com.cloudflare.api.account"}},
+}
+
+// Server is a fake Cloudflare API backed by an httptest.Server. All state is
+// kept in memory and is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mu               sync.Mutex
+	tokens           map[string]*cloudflare.APIToken
+	values           map[string]string
+	owners           map[string]string
+	permissionGroups []cloudflare.APITokenPermissionGroups
+	lastHeader       http.Header
+	failures         []failure
+
+	// apiKeys maps the email of a user to their Global API Key
+	apiKeys map[string]string
+
+	zones []cloudflare.Zone
+}
+
+type failure struct {
+	method  string
+	path    string
+	status  int
+	applied bool
+}
+
+// NewServer starts a fake Cloudflare API. Callers should Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		tokens:           make(map[string]*cloudflare.APIToken),
+		values:           make(map[string]string),
+		owners:           make(map[string]string),
+		permissionGroups: DefaultPermissionGroups,
+		apiKeys:          make(map[string]string),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// ClientOptions returns the options needed to point a cloudflare.API client
+// at the fake. Rate limiting and retries are disabled so tests run quickly.
+func (s *Server) ClientOptions() []cloudflare.Option {
+	return []cloudflare.Option{
+		cloudflare.BaseURL(s.URL),
+		cloudflare.UsingRateLimit(10000),
+		cloudflare.UsingRetryPolicy(0, 0, 0),
+	}
+}
+
+// AddToken stores token directly, bypassing the API. A missing ID, value or
+// status is filled in. The stored token, including its value, is returned.
+func (s *Server) AddToken(token cloudflare.APIToken) cloudflare.APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addTokenLocked(token, "")
+}
+
+// AddAccountToken stores token as owned by the account with the given ID. It
+// can only be managed through that account's token endpoints.
+func (s *Server) AddAccountToken(accountID string, token cloudflare.APIToken) cloudflare.APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addTokenLocked(token, accountID)
+}
+
+// AccountRootToken adds a token owned by the account with the given ID that
+// is allowed to manage the account's API tokens.
+func (s *Server) AccountRootToken(accountID string) cloudflare.APIToken {
+	return s.AddAccountToken(accountID, cloudflare.APIToken{
+		Name: fmt.Sprintf("vault-root-%d", time.Now().UnixNano()),
+		Policies: []cloudflare.APITokenPolicies{
+			{
+				Effect:           "allow",
+				Resources:        map[string]interface{}{"com.cloudflare.api.account." + accountID: "*"},
+				PermissionGroups: []cloudflare.APITokenPermissionGroups{s.permissionGroup("Account API Tokens Write")},
+			},
+		},
+	})
+}
+
+// TokenOwner returns the ID of the account owning the token with the given
+// ID, or "" for tokens owned by the user.
+func (s *Server) TokenOwner(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.owners[id]
+}
+
+// RootToken adds a token that is allowed to manage other API tokens.
+func (s *Server) RootToken() cloudflare.APIToken {
+	return s.AddToken(cloudflare.APIToken{
+		Name: fmt.Sprintf("vault-root-%d", time.Now().UnixNano()),
+		Policies: []cloudflare.APITokenPolicies{
+			{
+				Effect:           "allow",
+				Resources:        map[string]interface{}{"com.cloudflare.api.user.*": "*"},
+				PermissionGroups: []cloudflare.APITokenPermissionGroups{s.permissionGroups[0]},
+			},
+		},
+	})
+}
+
+// AddAPIKey creates a Global API Key for the user with the given email and
+// returns it.
+func (s *Server) AddAPIKey(email string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := randomHex(tokenValueLength / 2)
+	s.apiKeys[email] = key
+
+	return key
+}
+
+// AddZone adds a zone with the given name to the account with the given ID
+// and returns it.
+func (s *Server) AddZone(name, accountID string) cloudflare.Zone {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zone := cloudflare.Zone{
+		ID:     randomHex(16),
+		Name:   name,
+		Status: "active",
+	}
+	zone.Account.ID = accountID
+	s.zones = append(s.zones, zone)
+
+	return zone
+}
+
+// SetPermissionGroups replaces the permission group catalog served by the
+// fake.
+func (s *Server) SetPermissionGroups(groups []cloudflare.APITokenPermissionGroups) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.permissionGroups = groups
+}
+
+// Token returns the stored token with the given ID.
+func (s *Server) Token(id string) (cloudflare.APIToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return cloudflare.APIToken{}, false
+	}
+	return *token, true
+}
+
+// LastRequestHeader returns the headers of the most recent request received by
+// the fake.
+func (s *Server) LastRequestHeader() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastHeader.Clone()
+}
+
+// Fail makes the next request matching method and path fail with status. If
+// applied is true the request is still processed before the failure is
+// returned, simulating a response that was lost in transit.
+func (s *Server) Fail(method, path string, status int, applied bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, failure{method: method, path: path, status: status, applied: applied})
+}
+
+// Tokens returns every stored token, sorted by ID.
+func (s *Server) Tokens() []cloudflare.APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := make([]cloudflare.APIToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, *token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	return tokens
+}
+
+func (s *Server) permissionGroup(name string) cloudflare.APITokenPermissionGroups {
+	for _, group := range s.permissionGroups {
+		if group.Name == name {
+			return group
+		}
+	}
+	panic(fmt.Sprintf("unknown permission group %q", name))
+}
+
+func (s *Server) addTokenLocked(token cloudflare.APIToken, owner string) cloudflare.APIToken {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	if token.ID == "" {
+		token.ID = randomHex(16)
+	}
+	if token.Value == "" {
+		token.Value = randomHex(tokenValueLength / 2)
+	}
+	if token.Status == "" {
+		token.Status = "active"
+	}
+	if token.IssuedOn == nil {
+		token.IssuedOn = &now
+	}
+	token.ModifiedOn = &now
+
+	s.tokens[token.ID] = &token
+	s.values[token.Value] = token.ID
+	s.owners[token.ID] = owner
+
+	return token
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastHeader = r.Header.Clone()
+
+	for i, f := range s.failures {
+		if f.method != r.Method || f.path != r.URL.Path {
+			continue
+		}
+		s.failures = append(s.failures[:i], s.failures[i+1:]...)
+
+		if f.applied {
+			s.handle(httptest.NewRecorder(), r)
+		}
+		writeError(w, f.status, cloudflare.ResponseInfo{Code: 10000, Message: "Injected failure"})
+		return
+	}
+
+	s.handle(w, r)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	caller, status, errs := s.authenticate(r)
+	if errs != nil {
+		writeError(w, status, errs...)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "user" && r.Method == http.MethodGet {
+		s.userDetails(w, r)
+		return
+	}
+	if len(parts) == 1 && parts[0] == "zones" && r.Method == http.MethodGet {
+		s.listZones(w, r)
+		return
+	}
+
+	// tokens owned by the user live under /user/tokens while tokens owned by an
+	// account live under /accounts/<id>/tokens. Each is only visible through
+	// the endpoints of its owner.
+	var owner string
+	switch {
+	case len(parts) >= 2 && parts[0] == "user" && parts[1] == "tokens":
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "accounts" && parts[2] == "tokens":
+		owner = parts[1]
+		parts = parts[3:]
+	default:
+		writeError(w, http.StatusNotFound, cloudflare.ResponseInfo{Code: 7003, Message: "No route for that URI"})
+		return
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		s.listTokens(w, owner)
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		s.createToken(w, r, caller, owner)
+	case len(parts) == 1 && parts[0] == "verify" && r.Method == http.MethodGet:
+		s.verifyToken(w, caller, owner)
+	case len(parts) == 1 && parts[0] == "permission_groups" && r.Method == http.MethodGet:
+		writeResult(w, s.permissionGroups)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.getToken(w, parts[0], owner)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		s.updateToken(w, r, caller, parts[0], owner)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteToken(w, parts[0], owner)
+	case len(parts) == 2 && parts[1] == "value" && r.Method == http.MethodPut:
+		s.rollToken(w, parts[0], owner)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, cloudflare.ResponseInfo{Code: 10405, Message: "Method not allowed"})
+	}
+}
+
+// authenticate resolves the token making the request. Expired tokens are only
+// allowed to call the verify endpoint so they can observe their own status.
+// Requests authenticated with a Global API Key have no calling token.
+func (s *Server) authenticate(r *http.Request) (*cloudflare.APIToken, int, []cloudflare.ResponseInfo) {
+	if key := r.Header.Get("X-Auth-Key"); key != "" {
+		if expected, ok := s.apiKeys[r.Header.Get("X-Auth-Email")]; !ok || expected != key {
+			return nil, http.StatusForbidden, []cloudflare.ResponseInfo{{Code: 9103, Message: "Unknown X-Auth-Key or X-Auth-Email"}}
+		}
+		return nil, 0, nil
+	}
+
+	value := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(value) != tokenValueLength {
+		return nil, http.StatusBadRequest, []cloudflare.ResponseInfo{{Code: 6003, Message: "Invalid request headers"}}
+	}
+
+	id, ok := s.values[value]
+	if !ok {
+		return nil, http.StatusUnauthorized, []cloudflare.ResponseInfo{{Code: 1000, Message: "Invalid API Token"}}
+	}
+	token := s.tokens[id]
+
+	if tokenStatus(token) != "active" && !strings.HasSuffix(r.URL.Path, "/verify") {
+		return nil, http.StatusUnauthorized, []cloudflare.ResponseInfo{{Code: 1000, Message: "Invalid API Token"}}
+	}
+
+	return token, 0, nil
+}
+
+func (s *Server) listTokens(w http.ResponseWriter, owner string) {
+	tokens := make([]cloudflare.APIToken, 0, len(s.tokens))
+	for id, token := range s.tokens {
+		if s.owners[id] == owner {
+			tokens = append(tokens, withoutValue(*token))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	writeResult(w, tokens)
+}
+
+// createToken creates a token owned by owner. Like the real API, tokens may
+// not create tokens that are themselves allowed to manage tokens; only
+// requests authenticated with a Global API Key (a nil caller) can.
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request, caller *cloudflare.APIToken, owner string) {
+	var token cloudflare.APIToken
+	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+		writeError(w, http.StatusBadRequest, cloudflare.ResponseInfo{Code: 6007, Message: "Malformed JSON in request body"})
+		return
+	}
+	if token.Name == "" {
+		writeError(w, http.StatusBadRequest, cloudflare.ResponseInfo{Code: 1001, Message: "name is required"})
+		return
+	}
+	if errs := s.validatePolicies(token.Policies); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, errs...)
+		return
+	}
+	if caller != nil && s.managesTokens(token.Policies) {
+		writeError(w, http.StatusBadRequest, cloudflare.ResponseInfo{Code: 1001, Message: "sub-token is not allowed to have permissions to manage other tokens"})
+		return
+	}
+
+	token.ID = ""
+	token.Value = ""
+	token.Status = ""
+	token.IssuedOn = nil
+
+	writeResult(w, s.addTokenLocked(token, owner))
+}
+
+func (s *Server) userDetails(w http.ResponseWriter, r *http.Request) {
+	email := r.Header.Get("X-Auth-Email")
+	if email == "" {
+		writeError(w, http.StatusForbidden, cloudflare.ResponseInfo{Code: 9109, Message: "Unauthorized to access requested resource"})
+		return
+	}
+
+	writeResult(w, cloudflare.User{ID: randomHex(16), Email: email})
+}
+
+// listZones serves a single page of the zones matching the name and
+// account.id filters of the request.
+func (s *Server) listZones(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	zones := []cloudflare.Zone{}
+	for _, zone := range s.zones {
+		if name := query.Get("name"); name != "" && zone.Name != name {
+			continue
+		}
+		if accountID := query.Get("account.id"); accountID != "" && zone.Account.ID != accountID {
+			continue
+		}
+		zones = append(zones, zone)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cloudflare.ZonesResponse{
+		Response: cloudflare.Response{Success: true, Errors: []cloudflare.ResponseInfo{}, Messages: []cloudflare.ResponseInfo{}},
+		Result:   zones,
+		ResultInfo: cloudflare.ResultInfo{
+			Page:       1,
+			PerPage:    len(zones),
+			TotalPages: 1,
+			Count:      len(zones),
+			Total:      len(zones),
+		},
+	})
+}
+
+func (s *Server) verifyToken(w http.ResponseWriter, caller *cloudflare.APIToken, owner string) {
+	if caller == nil || s.owners[caller.ID] != owner {
+		writeError(w, http.StatusBadRequest, cloudflare.ResponseInfo{Code: 1000, Message: "Invalid API Token"})
+		return
+	}
+
+	result := map[string]interface{}{
+		"id":     caller.ID,
+		"status": tokenStatus(caller),
+	}
+	if caller.NotBefore != nil {
+		result["not_before"] = caller.NotBefore
+	}
+	if caller.ExpiresOn != nil {
+		result["expires_on"] = caller.ExpiresOn
+	}
+
+	writeResult(w, result)
+}
+
+func (s *Server) getToken(w http.ResponseWriter, id, owner string) {
+	token, ok := s.ownedToken(id, owner)
+	if !ok {
+		writeTokenNotFound(w)
+		return
+	}
+
+	writeResult(w, withoutValue(*token))
+}
+
+// updateToken replaces the token with the one in the request like the real
+// API, so fields missing from the request are cleared rather than kept. As
+// with createToken, a token may not grant another token permissions to manage
+// tokens, though it may keep its own.
+func (s *Server) updateToken(w http.ResponseWriter, r *http.Request, caller *cloudflare.APIToken, id, owner string) {
+	token, ok := s.ownedToken(id, owner)
+	if !ok {
+		writeTokenNotFound(w)
+		return
+	}
+
+	var update cloudflare.APIToken
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, cloudflare.ResponseInfo{Code: 6007, Message: "Malformed JSON in request body"})
+		return
+	}
+	if update.Name == "" {
+		writeError(w, http.StatusBadRequest, cloudflare.ResponseInfo{Code: 1001, Message: "name is required"})
+		return
+	}
+	if len(update.Policies) == 0 {
+		writeError(w, http.StatusBadRequest, cloudflare.ResponseInfo{Code: 1001, Message: "policies are required"})
+		return
+	}
+	if errs := s.validatePolicies(update.Policies); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, errs...)
+		return
+	}
+	if caller != nil && caller.ID != id && s.managesTokens(update.Policies) {
+		writeError(w, http.StatusBadRequest, cloudflare.ResponseInfo{Code: 1001, Message: "sub-token is not allowed to have permissions to manage other tokens"})
+		return
+	}
+
+	token.Name = update.Name
+	token.Status = update.Status
+	if token.Status == "" {
+		token.Status = "active"
+	}
+	token.Policies = update.Policies
+	token.Condition = update.Condition
+	token.NotBefore = update.NotBefore
+	token.ExpiresOn = update.ExpiresOn
+	now := time.Now().UTC().Truncate(time.Second)
+	token.ModifiedOn = &now
+
+	writeResult(w, withoutValue(*token))
+}
+
+func (s *Server) deleteToken(w http.ResponseWriter, id, owner string) {
+	token, ok := s.ownedToken(id, owner)
+	if !ok {
+		writeTokenNotFound(w)
+		return
+	}
+
+	delete(s.values, token.Value)
+	delete(s.tokens, id)
+	delete(s.owners, id)
+
+	writeResult(w, map[string]string{"id": id})
+}
+
+func (s *Server) rollToken(w http.ResponseWriter, id, owner string) {
+	token, ok := s.ownedToken(id, owner)
+	if !ok {
+		writeTokenNotFound(w)
+		return
+	}
+
+	delete(s.values, token.Value)
+	token.Value = randomHex(tokenValueLength / 2)
+	s.values[token.Value] = id
+
+	writeResult(w, token.Value)
+}
+
+// ownedToken returns the token with the given ID if it belongs to owner.
+func (s *Server) ownedToken(id, owner string) (*cloudflare.APIToken, bool) {
+	token, ok := s.tokens[id]
+	if !ok || s.owners[id] != owner {
+		return nil, false
+	}
+	return token, true
+}
+
+func (s *Server) validatePolicies(policies []cloudflare.APITokenPolicies) []cloudflare.ResponseInfo {
+	var errs []cloudflare.ResponseInfo
+	for _, policy := range policies {
+		if policy.Effect != "allow" && policy.Effect != "deny" {
+			errs = append(errs, cloudflare.ResponseInfo{Code: 1001, Message: fmt.Sprintf("invalid policy effect %q", policy.Effect)})
+		}
+		for _, group := range policy.PermissionGroups {
+			if !s.knownPermissionGroup(group.ID) {
+				errs = append(errs, cloudflare.ResponseInfo{Code: 1001, Message: fmt.Sprintf("invalid permission group %q", group.ID)})
+			}
+		}
+	}
+	return errs
+}
+
+// managesTokens reports whether policies grant a permission group that allows
+// managing API tokens.
+func (s *Server) managesTokens(policies []cloudflare.APITokenPolicies) bool {
+	for _, policy := range policies {
+		if policy.Effect != "allow" {
+			continue
+		}
+		for _, group := range policy.PermissionGroups {
+			for _, known := range s.permissionGroups {
+				if known.ID == group.ID && (known.Name == "API Tokens Write" || known.Name == "Account API Tokens Write") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) knownPermissionGroup(id string) bool {
+	for _, group := range s.permissionGroups {
+		if group.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenStatus(token *cloudflare.APIToken) string {
+	if token.Status != "active" {
+		return token.Status
+	}
+	if token.ExpiresOn != nil && time.Now().After(*token.ExpiresOn) {
+		return "expired"
+	}
+	return token.Status
+}
+
+func withoutValue(token cloudflare.APIToken) cloudflare.APIToken {
+	token.Value = ""
+	return token
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func writeTokenNotFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, cloudflare.ResponseInfo{Code: 1003, Message: "Invalid API Token"})
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"errors":   []cloudflare.ResponseInfo{},
+		"messages": []cloudflare.ResponseInfo{},
+		"result":   result,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, errs ...cloudflare.ResponseInfo) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  false,
+		"errors":   errs,
+		"messages": []cloudflare.ResponseInfo{},
+		"result":   nil,
+	})
+}
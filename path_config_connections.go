@@ -0,0 +1,195 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// connectionPrefix holds the configuration of named connections. The default
+// connection, which has an empty name, is stored at config/token.
+const connectionPrefix = "config/connections/"
+
+// connectionPendingRotationPrefix holds the pending rotation records of named
+// connections. See pendingRotationKey.
+const connectionPendingRotationPrefix = "config/connection-pending-rotation/"
+
+func pathListConnections(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/connections/?$",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathConnectionList,
+		},
+
+		HelpSynopsis:    pathListConnectionsHelpSyn,
+		HelpDescription: pathListConnectionsHelpDesc,
+	}
+}
+
+func pathConnections(b *backend) *framework.Path {
+	fields := connectionFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of the connection",
+	}
+
+	return &framework.Path{
+		Pattern: "config/connections/" + framework.GenericNameRegex("name"),
+		Fields:  fields,
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathConfigTokenRead,
+			logical.CreateOperation: b.pathConfigTokenWrite,
+			logical.UpdateOperation: b.pathConfigTokenWrite,
+			logical.DeleteOperation: b.pathConfigTokenDelete,
+		},
+
+		ExistenceCheck: b.configTokenExistenceCheck,
+
+		HelpSynopsis:    pathConnectionsHelpSyn,
+		HelpDescription: pathConnectionsHelpDesc,
+	}
+}
+
+func pathConnectionRotateRoot(b *backend) *framework.Path {
+	path := pathConfigRotateRoot(b)
+	path.Pattern = "config/connections/" + framework.GenericNameRegex("name") + "/rotate-root"
+	path.Fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of the connection",
+	}
+
+	return path
+}
+
+func (b *backend) pathConnectionList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, connectionPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(entries), nil
+}
+
+// connectionNames returns the names of every connection of this mount,
+// starting with the default connection.
+func (b *backend) connectionNames(ctx context.Context, s logical.Storage) ([]string, error) {
+	names, err := s.List(ctx, connectionPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{""}, names...), nil
+}
+
+// connectionUsers returns the names of the roles that create tokens with the
+// named connection and the IDs of the issued tokens that are still managed
+// through it.
+func (b *backend) connectionUsers(ctx context.Context, s logical.Storage, name string) ([]string, []string, error) {
+	roleNames, err := s.List(ctx, "role/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var roles []string
+	for _, roleName := range roleNames {
+		role, err := b.roleRead(ctx, s, roleName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if role != nil && role.Connection == name {
+			roles = append(roles, roleName)
+		}
+	}
+
+	ids, err := s.List(ctx, tokenPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tokens []string
+	for _, id := range ids {
+		token, err := b.tokenEntry(ctx, s, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if token != nil && token.Connection == name {
+			tokens = append(tokens, id)
+		}
+	}
+
+	return roles, tokens, nil
+}
+
+// connectionName returns the name of the connection addressed by a request,
+// which is empty for requests to config/token.
+func connectionName(d *framework.FieldData) string {
+	if name, ok := d.GetOk("name"); ok {
+		return name.(string)
+	}
+	return ""
+}
+
+// connectionStorageKey returns where the configuration of the named
+// connection is stored.
+func connectionStorageKey(name string) string {
+	if name == "" {
+		return configTokenKey
+	}
+	return connectionPrefix + name
+}
+
+// connectionPath returns the API path used to configure the named connection.
+func connectionPath(name string) string {
+	if name == "" {
+		return "config/token"
+	}
+	return "config/connections/" + name
+}
+
+// connectionRotateRootPath returns the API path used to rotate the root token
+// of the named connection.
+func connectionRotateRootPath(name string) string {
+	if name == "" {
+		return "config/rotate-root"
+	}
+	return fmt.Sprintf("config/connections/%s/rotate-root", name)
+}
+
+// pendingRotationStorageKey returns where the pending rotation record of the
+// named connection is stored.
+func pendingRotationStorageKey(name string) string {
+	if name == "" {
+		return pendingRotationKey
+	}
+	return connectionPendingRotationPrefix + name
+}
+
+const pathListConnectionsHelpSyn = `List the named cloudflare connections of this mount`
+
+const pathListConnectionsHelpDesc = `Connections will be listed by name. The
+connection configured at config/token is not included.`
+
+const pathConnectionsHelpSyn = `
+Configure a named cloudflare connection used by vault
+`
+
+const pathConnectionsHelpDesc = `
+A named connection holds a root credential and the options used to reach
+cloudflare with it, in addition to the connection configured at config/token.
+This allows a single mount to issue tokens from several cloudflare accounts.
+
+Connections accept the same fields as config/token. Roles select the
+connection they issue tokens from with their 'connection' field, and the lease
+of every issued token records its connection so it can still be renewed and
+revoked after the role changes. Root tokens of named connections are rotated
+at config/connections/<name>/rotate-root.
+
+A connection cannot be deleted while a role uses it or while it manages a
+token recorded in 'tokens/'. Leases issued before 'tokens/' existed are not
+recorded and should be revoked first. Root tokens retired by the connection
+are deleted along with it.
+`
@@ -0,0 +1,253 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/base62"
+	"github.com/hashicorp/vault/sdk/helper/template"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const nameTemplateConfigKey = "config/name-template"
+
+// maxTokenNameLength is the maximum length of the name of a cloudflare token.
+const maxTokenNameLength = 120
+
+// defaultNameTemplate names tokens when neither their role nor the mount
+// configures a template.
+const defaultNameTemplate = `vault-{{ .RoleName | lowercase }}-{{ .RandomSuffix }}`
+
+// randomSuffixLength is the length of the random suffix available to name
+// templates.
+const randomSuffixLength = 8
+
+// randomSuffixPlaceholder stands in for the random suffix while a name is
+// rendered so truncation can tell where it is.
+const randomSuffixPlaceholder = "\x00"
+
+func pathConfigNameTemplate(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/name-template",
+		Fields: map[string]*framework.FieldSchema{
+			"name_template": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Template for the names of tokens whose role does not set 'name_template'",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathNameTemplateRead,
+			logical.UpdateOperation: b.pathNameTemplateUpdate,
+			logical.DeleteOperation: b.pathNameTemplateDelete,
+		},
+
+		HelpSynopsis:    pathConfigNameTemplateHelpSyn,
+		HelpDescription: pathConfigNameTemplateHelpDesc,
+	}
+}
+
+func (b *backend) pathNameTemplateUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	nameTemplate := d.Get("name_template").(string)
+	if err := checkNameTemplate(nameTemplate); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid 'name_template': %s", err)), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(nameTemplateConfigKey, &configNameTemplate{
+		NameTemplate: nameTemplate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathNameTemplateDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, nameTemplateConfigKey); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathNameTemplateRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	conf, err := b.nameTemplateConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	nameTemplate := defaultNameTemplate
+	if conf != nil {
+		nameTemplate = conf.NameTemplate
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name_template": nameTemplate,
+		},
+	}, nil
+}
+
+func (b *backend) nameTemplateConfig(ctx context.Context, s logical.Storage) (*configNameTemplate, error) {
+	entry, err := s.Get(ctx, nameTemplateConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result configNameTemplate
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// configNameTemplate is the mount's default template for token names.
+type configNameTemplate struct {
+	NameTemplate string `json:"name_template"`
+}
+
+// tokenNameData is the data available to name templates.
+type tokenNameData struct {
+	RoleName     string
+	DisplayName  string
+	EntityID     string
+	RequestID    string
+	RandomSuffix string
+}
+
+// tokenName names a token issued from the named role for req, using the
+// role's template, then the mount's, then the default.
+func (b *backend) tokenName(ctx context.Context, req *logical.Request, roleName string, role *cloudflareRoleEntry) (string, error) {
+	nameTemplate := role.NameTemplate
+	if nameTemplate == "" {
+		conf, err := b.nameTemplateConfig(ctx, req.Storage)
+		if err != nil {
+			return "", err
+		}
+		if conf != nil {
+			nameTemplate = conf.NameTemplate
+		}
+	}
+	if nameTemplate == "" {
+		nameTemplate = defaultNameTemplate
+	}
+
+	return generateTokenName(nameTemplate, tokenNameData{
+		RoleName:    roleName,
+		DisplayName: req.DisplayName,
+		EntityID:    req.EntityID,
+		RequestID:   req.ID,
+	})
+}
+
+// checkNameTemplate returns an error if nameTemplate cannot be rendered or
+// does not reference {{.RandomSuffix}}.
+func checkNameTemplate(nameTemplate string) error {
+	rendered, err := renderNameTemplate(nameTemplate, tokenNameData{RoleName: "role"})
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(rendered, randomSuffixPlaceholder) {
+		return fmt.Errorf("template must include {{.RandomSuffix}} so token names are unique")
+	}
+	return nil
+}
+
+// generateTokenName renders nameTemplate with data and a fresh random suffix.
+// A suffix is appended if the rendered name does not contain one, e.g. for a
+// template that only includes it conditionally. Names longer than
+// maxTokenNameLength are shortened around the random suffix so it is always
+// kept.
+func generateTokenName(nameTemplate string, data tokenNameData) (string, error) {
+	rendered, err := renderNameTemplate(nameTemplate, data)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(rendered, randomSuffixPlaceholder) {
+		rendered += "-" + randomSuffixPlaceholder
+	}
+
+	suffix, err := base62.Random(randomSuffixLength)
+	if err != nil {
+		return "", err
+	}
+	return truncateTokenName(rendered, suffix), nil
+}
+
+// renderNameTemplate renders nameTemplate with data, using
+// randomSuffixPlaceholder for the random suffix.
+func renderNameTemplate(nameTemplate string, data tokenNameData) (string, error) {
+	tmpl, err := template.NewTemplate(template.Template(nameTemplate))
+	if err != nil {
+		return "", err
+	}
+	data.RandomSuffix = randomSuffixPlaceholder
+	return tmpl.Generate(data)
+}
+
+// truncateTokenName replaces the placeholders in rendered with suffix. If the
+// result is too long the text before the first suffix is shortened, keeping
+// the separator in front of the suffix, and then the text after it. The first
+// suffix itself is never shortened.
+func truncateTokenName(rendered, suffix string) string {
+	name := strings.ReplaceAll(rendered, randomSuffixPlaceholder, suffix)
+	if len(name) <= maxTokenNameLength {
+		return name
+	}
+
+	i := strings.Index(rendered, randomSuffixPlaceholder)
+	if i < 0 {
+		return truncateUTF8(name, maxTokenNameLength)
+	}
+	head := rendered[:i]
+	tail := strings.ReplaceAll(rendered[i+len(randomSuffixPlaceholder):], randomSuffixPlaceholder, suffix)
+
+	available := maxTokenNameLength - len(suffix)
+	tail = truncateUTF8(tail, available)
+	available -= len(tail)
+	if len(head) <= available {
+		return head + suffix + tail
+	}
+	if last := head[len(head)-1]; available > 0 && strings.IndexByte("-_./:", last) >= 0 {
+		return truncateUTF8(head[:len(head)-1], available-1) + string(last) + suffix + tail
+	}
+	return truncateUTF8(head, available) + suffix + tail
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+const pathConfigNameTemplateHelpSyn = `
+Configure the default template for the names of issued tokens.
+`
+
+const pathConfigNameTemplateHelpDesc = `
+Tokens are named after this template unless their role sets its own
+'name_template'. Templates use Go template syntax with the variables
+{{.RoleName}}, {{.DisplayName}}, {{.EntityID}}, {{.RequestID}} and
+{{.RandomSuffix}}, as well as the functions of Vault's username templates
+(e.g. 'lowercase', 'truncate' and 'unix_time').
+
+Templates must include {{.RandomSuffix}}. Names longer than 120 characters
+are shortened around it so the suffix always keeps them unique. The default template is
+` + defaultNameTemplate + `.
+`
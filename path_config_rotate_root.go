@@ -2,16 +2,56 @@ package cloudflare
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
+	"github.com/cloudflare/cloudflare-go"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// pendingRotationKey holds the state of a root rotation of config/token that
+// has started but not yet been persisted. It allows a rotation that was
+// interrupted after the token was rolled to be recovered.
+const pendingRotationKey = "config/pending-rotation"
+
+// retiredRootTokenPrefix holds root tokens that were replaced by the
+// 'recreate' strategy and are waiting for their grace period to end before
+// they are deleted.
+const retiredRootTokenPrefix = "config/retired-root/"
+
+const (
+	rotationStrategyRoll     = "roll"
+	rotationStrategyRecreate = "recreate"
+)
+
+// defaultRotationGracePeriod is how long a root token replaced by the
+// 'recreate' strategy is kept before it is deleted.
+const defaultRotationGracePeriod = 10 * time.Minute
+
 func pathConfigRotateRoot(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "config/rotate-root",
+		Fields: map[string]*framework.FieldSchema{
+			"strategy": &framework.FieldSchema{
+				Type:          framework.TypeString,
+				Description:   "How the root token is rotated. 'roll' replaces the value of the existing token, immediately invalidating the old value. 'recreate' creates a new token with the same policies and conditions using 'minting_connection' and deletes the old token after 'grace_period'",
+				Default:       rotationStrategyRoll,
+				AllowedValues: []interface{}{rotationStrategyRoll, rotationStrategyRecreate},
+			},
+			"grace_period": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "How long the old root token remains valid when using the 'recreate' strategy",
+				Default:     int(defaultRotationGracePeriod.Seconds()),
+			},
+			"minting_connection": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of a connection with auth_type 'api_key' that creates the replacement token when using the 'recreate' strategy. Its Global API Key must belong to the user (or account) owning the root token",
+			},
+		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.UpdateOperation: &framework.PathOperation{
 				Callback: b.pathConfigRotateRootUpdate,
@@ -24,48 +64,400 @@ func pathConfigRotateRoot(b *backend) *framework.Path {
 }
 
 func (b *backend) pathConfigRotateRootUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	// have to get the client config first because that takes out a read lock
-	client, err := b.client(ctx, req.Storage)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	name := connectionName(data)
+	config, err := b.readConnection(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
-	if client == nil {
-		return nil, fmt.Errorf("nil client")
+	if config == nil {
+		return nil, fmt.Errorf("no configuration found for %s", connectionPath(name))
+	}
+	if config.authType() != authTypeAPIToken {
+		return logical.ErrorResponse(fmt.Sprintf("%s requires auth_type '%s'. rotate the Global API Key in the cloudflare dashboard instead", connectionRotateRootPath(name), authTypeAPIToken)), nil
+	}
+	if config.Token == "" {
+		return logical.ErrorResponse(fmt.Sprintf("Cannot call %s when token is empty", connectionRotateRootPath(name))), nil
+	}
+
+	switch strategy := data.Get("strategy").(string); strategy {
+	case rotationStrategyRoll:
+		if err := b.rotateRoot(ctx, req.Storage, config); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	case rotationStrategyRecreate:
+		// cloudflare does not allow an API token to create a token that can
+		// manage tokens, so the replacement is created with a Global API Key
+		mintingName := data.Get("minting_connection").(string)
+		if mintingName == "" {
+			return logical.ErrorResponse(fmt.Sprintf("the '%s' strategy requires 'minting_connection'", rotationStrategyRecreate)), nil
+		}
+		minting, err := b.readConnection(ctx, req.Storage, mintingName)
+		if err != nil {
+			return nil, err
+		}
+		if minting == nil {
+			return logical.ErrorResponse(fmt.Sprintf("minting connection '%s' does not exist. did you configure '%s'?", mintingName, connectionPath(mintingName))), nil
+		}
+		if minting.authType() != authTypeAPIKey {
+			return logical.ErrorResponse(fmt.Sprintf("minting connection '%s' must use auth_type '%s'. cloudflare does not allow API tokens to create tokens that can manage tokens", mintingName, authTypeAPIKey)), nil
+		}
+
+		gracePeriod := time.Duration(data.Get("grace_period").(int)) * time.Second
+		retired, err := b.recreateRoot(ctx, req.Storage, config, minting, gracePeriod)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"id":           config.TokenID,
+				"previous_id":  retired.TokenID,
+				"delete_after": formatTime(retired.DeleteAfter),
+			},
+		}, nil
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("unknown rotation strategy %q", strategy)), nil
 	}
 
-	tokenConfig, err := req.Storage.Get(ctx, configTokenKey)
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"id": config.TokenID,
+		},
+	}, nil
+}
+
+// rotateRoot rolls the value of the root token in config and persists it once
+// the new value has been verified. The caller must hold the write lock.
+//
+// The rotation happens in two phases. A pending rotation record is written
+// before the token is rolled and updated with the new value as soon as it is
+// known, so if Vault fails before config/token is updated the next rotation
+// can recover whichever value is still valid instead of bricking the mount.
+func (b *backend) rotateRoot(ctx context.Context, s logical.Storage, config *rootTokenConfig) error {
+	if err := b.recoverPendingRotation(ctx, s, config); err != nil {
+		return err
+	}
+
+	client, err := createClient(config, b.clientOptions...)
 	if err != nil {
+		return err
+	}
+
+	pendingKey := pendingRotationStorageKey(config.connection)
+	pending := &pendingRotation{
+		TokenID:   config.TokenID,
+		StartedAt: time.Now().UTC(),
+	}
+	if err := writePendingRotation(ctx, s, pendingKey, pending); err != nil {
+		return err
+	}
+
+	newToken, err := client.RollAPIToken(ctx, config.TokenID)
+	if err != nil {
+		// the roll may have been applied even though the request failed, so only
+		// forget about the rotation if the existing value still works
+		if verifyErr := b.verifyRootToken(ctx, config, config.Token); verifyErr == nil {
+			if err := s.Delete(ctx, pendingKey); err != nil {
+				return err
+			}
+			return fmt.Errorf("failed to roll root token (%s). the existing token was left in place. err: %s", config.TokenID, err)
+		}
+		return fmt.Errorf("failed to roll root token (%s) and the existing token can no longer be verified. the rotation will be recovered on the next call to %s. err: %s", config.TokenID, connectionRotateRootPath(config.connection), err)
+	}
+	if newToken == "" {
+		return fmt.Errorf("failed to roll root token (%s): cloudflare returned an empty token value", config.TokenID)
+	}
+
+	pending.NewToken = newToken
+	if err := writePendingRotation(ctx, s, pendingKey, pending); err != nil {
+		return err
+	}
+
+	if err := b.verifyRootToken(ctx, config, newToken); err != nil {
+		return fmt.Errorf("rolled root token (%s) but failed to verify the new value. the rotation will be recovered on the next call to %s. err: %s", config.TokenID, connectionRotateRootPath(config.connection), err)
+	}
+
+	config.Token = newToken
+	config.LastRotated = time.Now().UTC()
+	if err := b.writeConnection(ctx, s, config); err != nil {
+		return err
+	}
+	if err := s.Delete(ctx, pendingKey); err != nil {
+		return err
+	}
+
+	b.reset(config.connection)
+
+	return nil
+}
+
+// recreateRoot replaces the root token in config with a token that has the
+// same policies and conditions, created with the Global API Key of minting.
+// The old token stays valid for gracePeriod, giving in-flight requests on
+// other nodes time to finish, and is then deleted by the periodic function.
+// The caller must hold the write lock.
+func (b *backend) recreateRoot(ctx context.Context, s logical.Storage, config, minting *rootTokenConfig, gracePeriod time.Duration) (*retiredRootToken, error) {
+	if err := b.recoverPendingRotation(ctx, s, config); err != nil {
 		return nil, err
 	}
-	if tokenConfig == nil {
-		return nil, fmt.Errorf("no configuration found for config/token")
+
+	client, err := createClient(config, b.clientOptions...)
+	if err != nil {
+		return nil, err
 	}
-	var config rootTokenConfig
-	if err := tokenConfig.DecodeJSON(&config); err != nil {
-		return nil, errwrap.Wrapf("error reading root configuration: {{err}}", err)
+	mintingClient, err := createClient(minting, b.clientOptions...)
+	if err != nil {
+		return nil, err
 	}
+	// the replacement must be owned by whoever owns the current token
+	mintingClient = mintingClient.forAccount(config.AccountID)
 
-	if config.Token == "" {
-		return logical.ErrorResponse("Cannot call config/rotate-root when token is empty"), nil
+	current, err := client.GetAPIToken(ctx, config.TokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root token (%s). err: %s", config.TokenID, err)
 	}
 
-	newTokenValue, err := client.RollAPIToken(context.TODO(), config.TokenID)
+	policies := make([]cloudflare.APITokenPolicies, len(current.Policies))
+	for i, policy := range current.Policies {
+		policy.ID = ""
+		policies[i] = policy
+	}
+	created, err := mintingClient.CreateAPIToken(ctx, cloudflare.APIToken{
+		Name:      current.Name,
+		Policies:  policies,
+		Condition: current.Condition,
+		NotBefore: current.NotBefore,
+		ExpiresOn: current.ExpiresOn,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replacement for root token (%s). the existing token was left in place. err: %s", config.TokenID, err)
+	}
 
-	config.Token = newTokenValue
+	candidate := *config
+	candidate.TokenID = created.ID
+	if err := b.verifyRootToken(ctx, &candidate, created.Value); err != nil {
+		if deleteErr := mintingClient.DeleteAPIToken(ctx, created.ID); deleteErr != nil {
+			b.Logger().Error("failed to delete unverified replacement root token", "id", created.ID, "error", deleteErr)
+		}
+		return nil, fmt.Errorf("failed to verify replacement for root token (%s). the existing token was left in place. err: %s", config.TokenID, err)
+	}
 
-	newEntry, err := logical.StorageEntryJSON(configTokenKey, config)
+	retired := &retiredRootToken{
+		TokenID:     config.TokenID,
+		Connection:  config.connection,
+		AccountID:   config.AccountID,
+		RetiredAt:   time.Now().UTC(),
+		DeleteAfter: time.Now().UTC().Add(gracePeriod),
+	}
+
+	// the configuration is switched over before the old token is scheduled
+	// for deletion; failing in between leaks the old token rather than
+	// deleting the one that is still configured
+	config.Token = created.Value
+	config.TokenID = created.ID
+	config.LastRotated = retired.RetiredAt
+	config.setDetails(created)
+	if err := b.writeConnection(ctx, s, config); err != nil {
+		return nil, err
+	}
+	b.reset(config.connection)
+
+	entry, err := logical.StorageEntryJSON(retiredRootTokenPrefix+retired.TokenID, retired)
 	if err != nil {
-		return nil, errwrap.Wrapf("error generating new config/root JSON: {{err}}", err)
+		return nil, err
 	}
-	if err := req.Storage.Put(ctx, newEntry); err != nil {
-		return nil, errwrap.Wrapf("error saving new config/root: {{err}}", err)
+	if err := s.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("error saving retired root token: {{err}}", err)
 	}
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"id": config.TokenID,
-		},
-	}, nil
+	return retired, nil
+}
+
+// deleteRetiredRootTokens deletes root tokens replaced by the 'recreate'
+// strategy once their grace period has passed. Tokens that fail to delete are
+// retried on the next run.
+func (b *backend) deleteRetiredRootTokens(ctx context.Context, s logical.Storage) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	retiredTokens, err := b.retiredRootTokens(ctx, s)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, retired := range retiredTokens {
+		if now.Before(retired.DeleteAfter) {
+			continue
+		}
+
+		if err := b.deleteRetiredRootToken(ctx, s, retired); err != nil {
+			b.Logger().Error("failed to delete retired root token", "id", retired.TokenID, "connection", retired.Connection, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// retiredRootTokens returns every root token waiting to be deleted.
+func (b *backend) retiredRootTokens(ctx context.Context, s logical.Storage) ([]*retiredRootToken, error) {
+	ids, err := s.List(ctx, retiredRootTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	retiredTokens := make([]*retiredRootToken, 0, len(ids))
+	for _, id := range ids {
+		entry, err := s.Get(ctx, retiredRootTokenPrefix+id)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+
+		var retired retiredRootToken
+		if err := entry.DecodeJSON(&retired); err != nil {
+			return nil, err
+		}
+		retiredTokens = append(retiredTokens, &retired)
+	}
+
+	return retiredTokens, nil
+}
+
+// deleteRetiredRootToken deletes a retired root token from cloudflare, using
+// the client of its connection, and then forgets it. Tokens that are already
+// gone are only forgotten.
+func (b *backend) deleteRetiredRootToken(ctx context.Context, s logical.Storage, retired *retiredRootToken) error {
+	client, err := b.client(ctx, s, retired.Connection)
+	if err != nil {
+		return err
+	}
+	if err := client.forAccount(retired.AccountID).DeleteAPIToken(ctx, retired.TokenID); err != nil {
+		var responseError *cloudflare.APIRequestError
+		if !errors.As(err, &responseError) || responseError.HTTPStatusCode() != http.StatusNotFound {
+			return err
+		}
+	}
+	b.Logger().Info("deleted retired root token", "id", retired.TokenID)
+
+	return s.Delete(ctx, retiredRootTokenPrefix+retired.TokenID)
+}
+
+// recoverPendingRotation resolves a rotation that was interrupted before the
+// new value was persisted. config is updated in place with whichever value is
+// still valid.
+func (b *backend) recoverPendingRotation(ctx context.Context, s logical.Storage, config *rootTokenConfig) error {
+	pendingKey := pendingRotationStorageKey(config.connection)
+	entry, err := s.Get(ctx, pendingKey)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
+
+	var pending pendingRotation
+	if err := entry.DecodeJSON(&pending); err != nil {
+		return errwrap.Wrapf("error reading pending root rotation: {{err}}", err)
+	}
+
+	// the configuration was rewritten since the rotation started, which
+	// supersedes it, or the rotation never reached cloudflare
+	if pending.TokenID != config.TokenID || b.verifyRootToken(ctx, config, config.Token) == nil {
+		return s.Delete(ctx, pendingKey)
+	}
+
+	if pending.NewToken == "" || b.verifyRootToken(ctx, config, pending.NewToken) != nil {
+		return fmt.Errorf("a root token rotation started at %s could not be recovered and the configured token is no longer valid. reconfigure '%s' with a working token", pending.StartedAt.Format(time.RFC3339), connectionPath(config.connection))
+	}
+
+	b.Logger().Info("recovered interrupted root token rotation", "id", config.TokenID, "started_at", pending.StartedAt)
+
+	config.Token = pending.NewToken
+	if err := b.writeConnection(ctx, s, config); err != nil {
+		return err
+	}
+	if err := s.Delete(ctx, pendingKey); err != nil {
+		return err
+	}
+
+	b.reset(config.connection)
+
+	return nil
+}
+
+// rotateRootIfDue rotates the root token of the named connection if its
+// automatic rotation is due.
+func (b *backend) rotateRootIfDue(ctx context.Context, s logical.Storage, name string) error {
+	var next time.Time
+	due := func(config *rootTokenConfig) (bool, error) {
+		var err error
+		next, err = config.rotationDue(time.Now())
+		return !next.IsZero(), err
+	}
+
+	return b.withMaintenanceLock(ctx, s, name, due, func(config *rootTokenConfig) error {
+		b.Logger().Info("rotating root token", "id", config.TokenID, "due", next)
+		if err := b.rotateRoot(ctx, s, config); err != nil {
+			return fmt.Errorf("scheduled rotation of root token (%s) failed: %w", config.TokenID, err)
+		}
+
+		return nil
+	})
+}
+
+// verifyRootToken checks that token is an active value for the root token in
+// config.
+func (b *backend) verifyRootToken(ctx context.Context, config *rootTokenConfig, token string) error {
+	candidate := *config
+	candidate.Token = token
+
+	client, err := createClient(&candidate, b.clientOptions...)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.VerifyAPIToken(ctx)
+	if err != nil {
+		return err
+	}
+	if resp.Status != "active" {
+		return fmt.Errorf("token is not active (status: %s)", resp.Status)
+	}
+	if resp.ID != config.TokenID {
+		return fmt.Errorf("token belongs to '%s' instead of '%s'", resp.ID, config.TokenID)
+	}
+
+	return nil
+}
+
+func writePendingRotation(ctx context.Context, s logical.Storage, key string, pending *pendingRotation) error {
+	entry, err := logical.StorageEntryJSON(key, pending)
+	if err != nil {
+		return errwrap.Wrapf("error generating pending rotation JSON: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("error saving pending rotation: {{err}}", err)
+	}
+	return nil
+}
+
+type retiredRootToken struct {
+	TokenID     string    `json:"id"`
+	Connection  string    `json:"connection,omitempty"`
+	AccountID   string    `json:"account_id,omitempty"`
+	RetiredAt   time.Time `json:"retired_at"`
+	DeleteAfter time.Time `json:"delete_after"`
+}
+
+type pendingRotation struct {
+	TokenID   string    `json:"id"`
+	NewToken  string    `json:"new_token,omitempty"`
+	StartedAt time.Time `json:"started_at"`
 }
 
 const pathConfigRotateRootHelpSyn = `
@@ -75,4 +467,27 @@ Request to rotate the root cloudflare token used by Vault
 const pathConfigRotateRootHelpDesc = `
 This path attempts to rotate the cloudflare credentials used by Vault for
 this mount. It is only valid if Vault has been configured to use cloudflare
-token via the config/token endpoint.`
+token via the config/token endpoint.
+
+The new value is verified with Cloudflare before it replaces the configured
+token. If the rotation is interrupted after the token was rolled, the next
+call to this endpoint recovers whichever value is still valid before rotating
+again.
+
+By default the token is rotated with the 'roll' strategy, which replaces its
+value and immediately invalidates the old one. The 'recreate' strategy instead
+creates a new token with the same policies and conditions, switches this mount
+to it, and deletes the old token once 'grace_period' has passed. This avoids
+breaking requests that are still using the old value on other nodes.
+
+Cloudflare does not allow API tokens to create tokens that can manage other
+tokens, so 'recreate' needs a 'minting_connection': a named connection
+configured with auth_type 'api_key' whose Global API Key belongs to the user
+(or account) that owns the root token. It is only used to create the
+replacement.
+
+The root token can also be rotated automatically by configuring
+'rotation_period' or 'rotation_schedule' on config/token.
+
+The root tokens of named connections are rotated the same way at
+config/connections/<name>/rotate-root.`
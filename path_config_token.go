@@ -3,23 +3,50 @@ package cloudflare
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/cloudflare/cloudflare-go"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/robfig/cron/v3"
 )
 
 const configTokenKey = "config/token"
 
+const (
+	// defaultExpiryWarningThreshold is how long before the root token expires
+	// that responses start carrying a warning when 'expiry_warning_threshold'
+	// is not configured.
+	defaultExpiryWarningThreshold = 7 * 24 * time.Hour
+
+	// defaultAutoExtendPeriod is how far into the future the expiry of the root
+	// token is pushed by 'auto_extend' when 'auto_extend_period' is not
+	// configured.
+	defaultAutoExtendPeriod = 30 * 24 * time.Hour
+)
+
+const (
+	authTypeAPIToken = "api_token"
+	authTypeAPIKey   = "api_key"
+)
+
+// apiTokensWritePermissionGroup is the permission group the root token needs
+// in order to create API tokens.
+const apiTokensWritePermissionGroup = "API Tokens Write"
+
+// accountAPITokensWritePermissionGroup is the permission group a root token
+// owned by an account needs in order to create account-owned API tokens.
+const accountAPITokensWritePermissionGroup = "Account API Tokens Write"
+
 func pathConfigToken(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "config/token",
-		Fields: map[string]*framework.FieldSchema{
-			"token": &framework.FieldSchema{
-				Type:        framework.TypeString,
-				Description: "Token for API calls",
-			},
-		},
+		Fields:  connectionFields(),
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:   b.pathConfigTokenRead,
@@ -29,11 +56,94 @@ func pathConfigToken(b *backend) *framework.Path {
 		},
 
 		ExistenceCheck: b.configTokenExistenceCheck,
+
+		HelpSynopsis:    pathConfigTokenHelpSyn,
+		HelpDescription: pathConfigTokenHelpDesc,
+	}
+}
+
+// connectionFields returns the fields used to configure a connection to
+// cloudflare, shared by config/token and config/connections/<name>.
+func connectionFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"auth_type": &framework.FieldSchema{
+			Type:          framework.TypeString,
+			Description:   "How Vault authenticates with cloudflare. 'api_token' (default) uses 'token', 'api_key' uses a Global API Key from 'key' and 'email'",
+			AllowedValues: []interface{}{authTypeAPIToken, authTypeAPIKey},
+		},
+		"token": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Token for API calls",
+		},
+		"email": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Email of the cloudflare user owning 'key'. Only used with auth_type 'api_key'",
+		},
+		"key": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Global API Key for API calls. Only used with auth_type 'api_key'",
+		},
+		"account_id": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "ID of the cloudflare account that owns the root token. If set, the root token is managed through the account-owned token endpoints and tokens are issued as account-owned tokens unless their role sets its own account_id",
+		},
+		"expose_token": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "If set, reading the configuration returns the full value of the root token or key. Otherwise only a masked suffix is returned. Can only be enabled in the request that sets 'token' or 'key'",
+		},
+		"api_base_url": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Base URL of the cloudflare API. Defaults to https://api.cloudflare.com/client/v4",
+		},
+		"request_timeout": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "Timeout for requests made to the cloudflare API. Defaults to 10 seconds",
+		},
+		"proxy_url": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "URL of the HTTP proxy used to reach the cloudflare API",
+		},
+		"ca_cert": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "PEM-encoded CA bundle used to verify the TLS certificate of the cloudflare API (or the proxy in front of it)",
+		},
+		"headers": &framework.FieldSchema{
+			Type:        framework.TypeKVPairs,
+			Description: "Additional static headers sent with every request to the cloudflare API",
+		},
+		"rotation_period": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "How often the root token is automatically rotated. Mutually exclusive with rotation_schedule",
+		},
+		"rotation_schedule": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Cron-style schedule (e.g. '0 0 1 * *' or '@monthly') on which the root token is automatically rotated. Mutually exclusive with rotation_period",
+		},
+		"rotation_window": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "How long after a scheduled time the rotation may still run. If the window is missed the rotation waits for the next scheduled time. Only valid with rotation_schedule",
+		},
+		"expiry_warning_threshold": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "How long before the root token expires that responses from this mount carry a warning. Defaults to 7 days",
+		},
+		"auto_extend": &framework.FieldSchema{
+			Type:        framework.TypeBool,
+			Description: "If set, the expiry of the root token is automatically pushed forward by 'auto_extend_period' once it is within 'expiry_warning_threshold'",
+		},
+		"auto_extend_period": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "How far into the future the expiry of the root token is set when it is automatically extended. Defaults to 30 days",
+		},
+		"permission_groups_refresh_interval": &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "How long the permission groups listed at permission-groups are cached before they are fetched from cloudflare again. Defaults to 24 hours",
+		},
 	}
 }
 
 func (b *backend) configTokenExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
-	entry, err := b.readConfigToken(ctx, req.Storage)
+	entry, err := b.readConnection(ctx, req.Storage, connectionName(data))
 	if err != nil {
 		return false, err
 	}
@@ -41,8 +151,10 @@ func (b *backend) configTokenExistenceCheck(ctx context.Context, req *logical.Re
 	return entry != nil, nil
 }
 
-func (b *backend) readConfigToken(ctx context.Context, storage logical.Storage) (*rootTokenConfig, error) {
-	entry, err := storage.Get(ctx, configTokenKey)
+// readConnection reads the configuration of the named connection, where ""
+// is the connection configured at config/token.
+func (b *backend) readConnection(ctx context.Context, storage logical.Storage, name string) (*rootTokenConfig, error) {
+	entry, err := storage.Get(ctx, connectionStorageKey(name))
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +162,7 @@ func (b *backend) readConfigToken(ctx context.Context, storage logical.Storage)
 		return nil, nil
 	}
 
-	conf := &rootTokenConfig{}
+	conf := &rootTokenConfig{connection: name}
 	if err := entry.DecodeJSON(conf); err != nil {
 		return nil, errwrap.Wrapf("error reading nomad access configuration: {{err}}", err)
 	}
@@ -58,74 +170,684 @@ func (b *backend) readConfigToken(ctx context.Context, storage logical.Storage)
 	return conf, nil
 }
 
+func (b *backend) writeConnection(ctx context.Context, storage logical.Storage, conf *rootTokenConfig) error {
+	entry, err := logical.StorageEntryJSON(connectionStorageKey(conf.connection), conf)
+	if err != nil {
+		return err
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		return err
+	}
+
+	b.setRootExpiry(conf.connection, conf)
+	return nil
+}
+
 func (b *backend) pathConfigTokenRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	conf, err := b.readConfigToken(ctx, req.Storage)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	name := connectionName(data)
+	conf, err := b.readConnection(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
 	if conf == nil {
-		return logical.ErrorResponse("configuration does not exist. did you configure 'config/token'?"), nil
+		return logical.ErrorResponse(fmt.Sprintf("configuration does not exist. did you configure '%s'?", connectionPath(name))), nil
+	}
+
+	nextRotation, err := conf.nextRotation(time.Now())
+	if err != nil {
+		return nil, err
 	}
 
-	return &logical.Response{
+	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"id":    conf.TokenID,
-			"token": conf.Token,
+			"auth_type":       conf.authType(),
+			"id":              conf.TokenID,
+			"masked_token":    maskToken(conf.Token),
+			"email":           conf.Email,
+			"masked_key":      maskToken(conf.APIKey),
+			"account_id":      conf.AccountID,
+			"expose_token":    conf.ExposeToken,
+			"api_base_url":    conf.APIBaseURL,
+			"request_timeout": int64(conf.RequestTimeout.Seconds()),
+			"proxy_url":       conf.ProxyURL,
+			"ca_cert":         conf.CACert,
+			"masked_headers":  maskHeaders(conf.Headers),
+
+			"rotation_period":   int64(conf.RotationPeriod.Seconds()),
+			"rotation_schedule": conf.RotationSchedule,
+			"rotation_window":   int64(conf.RotationWindow.Seconds()),
+			"last_rotated":      formatTime(conf.LastRotated),
+			"next_rotation":     formatTime(nextRotation),
+
+			"name":       conf.Name,
+			"policies":   conf.Policies,
+			"condition":  conf.Condition,
+			"not_before": formatTimePtr(conf.NotBefore),
+			"expires_on": formatTimePtr(conf.ExpiresOn),
+
+			"expiry_warning_threshold": int64(conf.expiryWarningThreshold().Seconds()),
+			"auto_extend":              conf.AutoExtend,
+			"auto_extend_period":       int64(conf.autoExtendPeriod().Seconds()),
+
+			"permission_groups_refresh_interval": int64(conf.permissionGroupsRefreshInterval().Seconds()),
 		},
-	}, nil
+	}
+	if conf.ExposeToken {
+		switch conf.authType() {
+		case authTypeAPIKey:
+			resp.Data["key"] = conf.APIKey
+		default:
+			resp.Data["token"] = conf.Token
+		}
+	}
+
+	return resp, nil
 }
 
 func (b *backend) pathConfigTokenWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	conf, err := b.readConfigToken(ctx, req.Storage)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	name := connectionName(data)
+	conf, err := b.readConnection(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
 	if conf == nil {
-		conf = &rootTokenConfig{}
+		conf = &rootTokenConfig{connection: name}
 	}
 
-	token, ok := data.GetOk("token")
-	if !ok {
-		return logical.ErrorResponse("Missing 'token' in configuration request"), nil
+	if authType, ok := data.GetOk("auth_type"); ok {
+		conf.AuthType = authType.(string)
+	}
+	// the root secret may only be exposed by the write that provides it, so
+	// access to update the configuration is not enough to read back a secret
+	// that was written by someone else
+	_, hasToken := data.GetOk("token")
+	_, hasKey := data.GetOk("key")
+	exposeToken, exposeTokenSet := data.GetOk("expose_token")
+	if exposeTokenSet && exposeToken.(bool) {
+		if !hasToken && !hasKey {
+			return logical.ErrorResponse("'expose_token' can only be enabled in the same request that sets 'token' or 'key'"), nil
+		}
 	}
-	conf.Token = token.(string)
 
-	client, err := createClient(conf.Token)
-	if err != nil {
-		return nil, err
+	switch conf.authType() {
+	case authTypeAPIToken:
+		token, ok := data.GetOk("token")
+		if ok {
+			conf.Token = token.(string)
+			conf.LastRotated = time.Now().UTC()
+		} else if conf.Token == "" {
+			return logical.ErrorResponse("Missing 'token' in configuration request"), nil
+		}
+		conf.Email = ""
+		conf.APIKey = ""
+	case authTypeAPIKey:
+		if email, ok := data.GetOk("email"); ok {
+			conf.Email = email.(string)
+		}
+		if key, ok := data.GetOk("key"); ok {
+			conf.APIKey = key.(string)
+			conf.LastRotated = time.Now().UTC()
+		}
+		if conf.Email == "" || conf.APIKey == "" {
+			return logical.ErrorResponse("Missing 'email' or 'key' in configuration request"), nil
+		}
+		conf.Token = ""
+		conf.TokenID = ""
+		conf.setDetails(cloudflare.APIToken{})
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("unknown auth_type %q. must be one of '%s' or '%s'", conf.AuthType, authTypeAPIToken, authTypeAPIKey)), nil
 	}
 
-	resp, err := client.VerifyAPIToken(context.TODO())
-	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("encountered error when verifying token: %s", err)), nil
+	if accountID, ok := data.GetOk("account_id"); ok {
+		conf.AccountID = accountID.(string)
 	}
-	if resp.Status != "active" {
-		return logical.ErrorResponse(fmt.Sprintf("provided token is not currently active. resp:%#v", resp)), nil
+	if exposeTokenSet {
+		conf.ExposeToken = exposeToken.(bool)
+	} else if hasToken || hasKey {
+		conf.ExposeToken = false
 	}
 
-	conf.TokenID = resp.ID
+	if apiBaseURL, ok := data.GetOk("api_base_url"); ok {
+		conf.APIBaseURL = apiBaseURL.(string)
+		if conf.APIBaseURL != "" {
+			u, err := url.Parse(conf.APIBaseURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return logical.ErrorResponse(fmt.Sprintf("invalid api_base_url %q: must be an absolute http(s) URL", conf.APIBaseURL)), nil
+			}
+		}
+	}
+	if requestTimeout, ok := data.GetOk("request_timeout"); ok {
+		conf.RequestTimeout = time.Duration(requestTimeout.(int)) * time.Second
+	}
+	if proxyURL, ok := data.GetOk("proxy_url"); ok {
+		conf.ProxyURL = proxyURL.(string)
+	}
+	if caCert, ok := data.GetOk("ca_cert"); ok {
+		conf.CACert = caCert.(string)
+	}
+	if headers, ok := data.GetOk("headers"); ok {
+		conf.Headers = headers.(map[string]string)
+		for k := range conf.Headers {
+			switch http.CanonicalHeaderKey(k) {
+			case "Authorization", "X-Auth-Key", "X-Auth-Email", "X-Auth-User-Service-Key":
+				return logical.ErrorResponse(fmt.Sprintf("header %q is reserved for authenticating with cloudflare and cannot be overridden", k)), nil
+			}
+		}
+	}
+
+	if rotationPeriod, ok := data.GetOk("rotation_period"); ok {
+		conf.RotationPeriod = time.Duration(rotationPeriod.(int)) * time.Second
+	}
+	if rotationSchedule, ok := data.GetOk("rotation_schedule"); ok {
+		conf.RotationSchedule = rotationSchedule.(string)
+	}
+	if rotationWindow, ok := data.GetOk("rotation_window"); ok {
+		conf.RotationWindow = time.Duration(rotationWindow.(int)) * time.Second
+	}
+	if conf.RotationPeriod > 0 && conf.RotationSchedule != "" {
+		return logical.ErrorResponse("only one of 'rotation_period' or 'rotation_schedule' may be set"), nil
+	}
+	if conf.RotationSchedule != "" {
+		if _, err := cron.ParseStandard(conf.RotationSchedule); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid rotation_schedule %q: %s", conf.RotationSchedule, err)), nil
+		}
+	} else if conf.RotationWindow > 0 {
+		return logical.ErrorResponse("'rotation_window' requires 'rotation_schedule'"), nil
+	}
+	if conf.authType() == authTypeAPIKey && (conf.RotationPeriod > 0 || conf.RotationSchedule != "") {
+		return logical.ErrorResponse(fmt.Sprintf("automatic rotation requires auth_type '%s'", authTypeAPIToken)), nil
+	}
+	if conf.LastRotated.IsZero() {
+		conf.LastRotated = time.Now().UTC()
+	}
 
-	entry, err := logical.StorageEntryJSON(configTokenKey, conf)
+	if threshold, ok := data.GetOk("expiry_warning_threshold"); ok {
+		conf.ExpiryWarningThreshold = time.Duration(threshold.(int)) * time.Second
+	}
+	if autoExtend, ok := data.GetOk("auto_extend"); ok {
+		conf.AutoExtend = autoExtend.(bool)
+	}
+	if autoExtendPeriod, ok := data.GetOk("auto_extend_period"); ok {
+		conf.AutoExtendPeriod = time.Duration(autoExtendPeriod.(int)) * time.Second
+	}
+	if conf.AutoExtend && conf.autoExtendPeriod() <= conf.expiryWarningThreshold() {
+		return logical.ErrorResponse("'auto_extend_period' must be longer than 'expiry_warning_threshold'"), nil
+	}
+
+	if refreshInterval, ok := data.GetOk("permission_groups_refresh_interval"); ok {
+		conf.PermissionGroupsRefreshInterval = time.Duration(refreshInterval.(int)) * time.Second
+	}
+
+	client, err := createClient(conf, b.clientOptions...)
 	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to create cloudflare client: %s", err)), nil
+	}
+
+	if conf.authType() == authTypeAPIKey {
+		// a Global API Key carries every permission of its user, so there is
+		// nothing to check beyond the key being valid
+		if _, err := client.UserDetails(ctx); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("encountered error when verifying api key: %s", err)), nil
+		}
+	} else {
+		resp, err := client.VerifyAPIToken(context.TODO())
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("encountered error when verifying token: %s", err)), nil
+		}
+		if resp.Status != "active" {
+			return logical.ErrorResponse(fmt.Sprintf("provided token is not currently active. resp:%#v", resp)), nil
+		}
+
+		conf.TokenID = resp.ID
+
+		details, err := client.GetAPIToken(ctx, conf.TokenID)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to read details of the provided token (%s). ensure it has the '%s' permission. err: %s", conf.TokenID, conf.tokensWritePermissionGroup(), err)), nil
+		}
+		if !canWriteAPITokens(details, conf.tokensWritePermissionGroup()) {
+			return logical.ErrorResponse(fmt.Sprintf("provided token (%s) is missing the '%s' permission required to create tokens", conf.TokenID, conf.tokensWritePermissionGroup())), nil
+		}
+		conf.setDetails(details)
+	}
+
+	if err := b.writeConnection(ctx, req.Storage, conf); err != nil {
 		return nil, err
 	}
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	// the new credential may see a different set of permission groups
+	if err := req.Storage.Delete(ctx, permissionGroupsStorageKey(name)); err != nil {
 		return nil, err
 	}
 
+	b.reset(name)
+
 	return nil, nil
 }
 
 func (b *backend) pathConfigTokenDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	if err := req.Storage.Delete(ctx, configTokenKey); err != nil {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// roles and outstanding leases would be left without a way to create or
+	// revoke their tokens
+	name := connectionName(data)
+	roles, tokens, err := b.connectionUsers(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) > 0 {
+		return logical.ErrorResponse(fmt.Sprintf("'%s' is still used by roles %s. delete them or move them to another connection first", connectionPath(name), strings.Join(roles, ", "))), nil
+	}
+	if len(tokens) > 0 {
+		return logical.ErrorResponse(fmt.Sprintf("'%s' still manages %d issued tokens recorded in 'tokens/'. revoke their leases first", connectionPath(name), len(tokens))), nil
+	}
+
+	// root tokens retired by the connection can no longer be deleted once it
+	// is gone, so they are deleted now instead of after their grace period
+	retiredTokens, err := b.retiredRootTokens(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, retired := range retiredTokens {
+		if retired.Connection != name {
+			continue
+		}
+		if err := b.deleteRetiredRootToken(ctx, req.Storage, retired); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to delete retired root token (%s) of '%s'. err: %s", retired.TokenID, connectionPath(name), err)), nil
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, connectionStorageKey(name)); err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Delete(ctx, pendingRotationStorageKey(name)); err != nil {
 		return nil, err
 	}
+	if err := req.Storage.Delete(ctx, permissionGroupsStorageKey(name)); err != nil {
+		return nil, err
+	}
+
+	b.reset(name)
+	b.setRootExpiry(name, nil)
+
 	return nil, nil
 }
 
+// withMaintenanceLock runs act on the root token of the named connection under
+// the write lock if due reports that there is something to do.
+func (b *backend) withMaintenanceLock(ctx context.Context, s logical.Storage, name string, due func(*rootTokenConfig) (bool, error), act func(*rootTokenConfig) error) error {
+	// maintenance runs every minute, so only take the write lock once the read
+	// lock shows there is something to do
+	b.lock.RLock()
+	conf, err := b.readConnection(ctx, s, name)
+	b.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if ok, err := due(conf); err != nil || !ok {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// the token may have been changed while the lock was released
+	conf, err = b.readConnection(ctx, s, name)
+	if err != nil {
+		return err
+	}
+	if ok, err := due(conf); err != nil || !ok {
+		return err
+	}
+
+	return act(conf)
+}
+
+// extendRootIfExpiring pushes the expiry of the root token of the named
+// connection forward when 'auto_extend' is set and the token is within its
+// warning threshold.
+func (b *backend) extendRootIfExpiring(ctx context.Context, s logical.Storage, name string) error {
+	due := func(conf *rootTokenConfig) (bool, error) {
+		return conf.extensionDue(time.Now()), nil
+	}
+
+	return b.withMaintenanceLock(ctx, s, name, due, func(conf *rootTokenConfig) error {
+		return b.extendRoot(ctx, s, conf)
+	})
+}
+
+// extendRoot pushes the expiry of the root token in conf forward by its
+// 'auto_extend' period. The caller must hold the write lock.
+func (b *backend) extendRoot(ctx context.Context, s logical.Storage, conf *rootTokenConfig) error {
+	client, err := b.client(ctx, s, conf.connection)
+	if err != nil {
+		return err
+	}
+
+	// updates replace the whole token, so start from its current state rather
+	// than what was recorded when it was configured
+	current, err := client.GetAPIToken(ctx, conf.TokenID)
+	if err != nil {
+		return fmt.Errorf("failed to read root token (%s) before extending it: %w", conf.TokenID, err)
+	}
+
+	expirationDate := time.Now().UTC().Add(conf.autoExtendPeriod()).Truncate(time.Second)
+	updated, err := client.UpdateAPIToken(ctx, conf.TokenID, cloudflare.APIToken{
+		Name:      current.Name,
+		Policies:  current.Policies,
+		Condition: current.Condition,
+		NotBefore: current.NotBefore,
+		ExpiresOn: &expirationDate,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to extend root token (%s): %w", conf.TokenID, err)
+	}
+	b.Logger().Info("extended root token", "id", conf.TokenID, "expires_on", expirationDate)
+
+	conf.setDetails(updated)
+	return b.writeConnection(ctx, s, conf)
+}
+
+// rootExpiry is the expiry of the root token of a connection as cached by the
+// backend.
+type rootExpiry struct {
+	tokenID          string
+	expiresOn        time.Time
+	warningThreshold time.Duration
+}
+
+// newRootExpiry returns the expiry of the root token in conf, if it has one.
+func newRootExpiry(conf *rootTokenConfig) (rootExpiry, bool) {
+	if conf == nil || conf.ExpiresOn == nil {
+		return rootExpiry{}, false
+	}
+	return rootExpiry{
+		tokenID:          conf.TokenID,
+		expiresOn:        *conf.ExpiresOn,
+		warningThreshold: conf.expiryWarningThreshold(),
+	}, true
+}
+
+// setRootExpiry caches the expiry of the root token in conf, which may be nil
+// if the named connection no longer exists.
+func (b *backend) setRootExpiry(name string, conf *rootTokenConfig) {
+	b.expiryMutex.Lock()
+	defer b.expiryMutex.Unlock()
+
+	if expiry, ok := newRootExpiry(conf); ok {
+		b.rootExpiries[name] = expiry
+	} else {
+		delete(b.rootExpiries, name)
+	}
+}
+
+// reloadRootExpiry refreshes the cached expiry of the root token of the named
+// connection from storage.
+func (b *backend) reloadRootExpiry(ctx context.Context, name string) {
+	if b.storage == nil {
+		return
+	}
+
+	conf, err := b.readConnection(ctx, b.storage, name)
+	if err != nil {
+		b.Logger().Error("failed to reload root token expiry", "connection", name, "error", err)
+		return
+	}
+	b.setRootExpiry(name, conf)
+}
+
+// loadRootExpiries replaces the cached expiries with those of the root token
+// of every connection in storage.
+func (b *backend) loadRootExpiries(ctx context.Context, s logical.Storage) error {
+	names, err := b.connectionNames(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	expiries := make(map[string]rootExpiry, len(names))
+	for _, name := range names {
+		conf, err := b.readConnection(ctx, s, name)
+		if err != nil {
+			return err
+		}
+		if expiry, ok := newRootExpiry(conf); ok {
+			expiries[name] = expiry
+		}
+	}
+
+	b.expiryMutex.Lock()
+	defer b.expiryMutex.Unlock()
+	b.rootExpiries = expiries
+
+	return nil
+}
+
+// rootExpiryWarnings returns warnings to attach to responses for every
+// connection whose root token is about to expire, ordered by connection.
+func (b *backend) rootExpiryWarnings(now time.Time) []string {
+	b.expiryMutex.RLock()
+	defer b.expiryMutex.RUnlock()
+
+	names := make([]string, 0, len(b.rootExpiries))
+	for name, expiry := range b.rootExpiries {
+		if expiry.expiresOn.Sub(now) < expiry.warningThreshold {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	for _, name := range names {
+		expiry := b.rootExpiries[name]
+		if !expiry.expiresOn.After(now) {
+			warnings = append(warnings, fmt.Sprintf("the root token (%s) configured at '%s' expired at %s. configure a new token to keep using this mount", expiry.tokenID, connectionPath(name), formatTime(expiry.expiresOn)))
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("the root token (%s) configured at '%s' expires at %s. extend it, set 'auto_extend', or configure a new token before then", expiry.tokenID, connectionPath(name), formatTime(expiry.expiresOn)))
+	}
+
+	return warnings
+}
+
 type rootTokenConfig struct {
-	Token   string `json:"token"`
-	TokenID string `json:"id"`
+	// connection is the name of the connection the configuration was read
+	// for. It is not persisted since it is implied by the storage key.
+	connection string
+
+	AuthType    string `json:"auth_type,omitempty"`
+	Token       string `json:"token"`
+	TokenID     string `json:"id"`
+	Email       string `json:"email,omitempty"`
+	APIKey      string `json:"key,omitempty"`
+	AccountID   string `json:"account_id,omitempty"`
+	ExposeToken bool   `json:"expose_token,omitempty"`
+
+	APIBaseURL     string            `json:"api_base_url,omitempty"`
+	RequestTimeout time.Duration     `json:"request_timeout,omitempty"`
+	ProxyURL       string            `json:"proxy_url,omitempty"`
+	CACert         string            `json:"ca_cert,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+
+	RotationPeriod   time.Duration `json:"rotation_period,omitempty"`
+	RotationSchedule string        `json:"rotation_schedule,omitempty"`
+	RotationWindow   time.Duration `json:"rotation_window,omitempty"`
+	LastRotated      time.Time     `json:"last_rotated"`
+
+	ExpiryWarningThreshold time.Duration `json:"expiry_warning_threshold,omitempty"`
+	AutoExtend             bool          `json:"auto_extend,omitempty"`
+	AutoExtendPeriod       time.Duration `json:"auto_extend_period,omitempty"`
+
+	PermissionGroupsRefreshInterval time.Duration `json:"permission_groups_refresh_interval,omitempty"`
+
+	// Details of the root token as reported by cloudflare
+	Name      string                        `json:"name,omitempty"`
+	Policies  []cloudflare.APITokenPolicies `json:"policies,omitempty"`
+	Condition *cloudflare.APITokenCondition `json:"condition,omitempty"`
+	NotBefore *time.Time                    `json:"not_before,omitempty"`
+	ExpiresOn *time.Time                    `json:"expires_on,omitempty"`
+}
+
+func (c *rootTokenConfig) authType() string {
+	if c.AuthType == "" {
+		return authTypeAPIToken
+	}
+	return c.AuthType
+}
+
+func (c *rootTokenConfig) expiryWarningThreshold() time.Duration {
+	if c.ExpiryWarningThreshold == 0 {
+		return defaultExpiryWarningThreshold
+	}
+	return c.ExpiryWarningThreshold
+}
+
+func (c *rootTokenConfig) autoExtendPeriod() time.Duration {
+	if c.AutoExtendPeriod == 0 {
+		return defaultAutoExtendPeriod
+	}
+	return c.AutoExtendPeriod
+}
+
+func (c *rootTokenConfig) permissionGroupsRefreshInterval() time.Duration {
+	if c.PermissionGroupsRefreshInterval == 0 {
+		return defaultPermissionGroupsRefreshInterval
+	}
+	return c.PermissionGroupsRefreshInterval
+}
+
+// expiringSoon reports whether the root token expires within the warning
+// threshold (or has already expired).
+func (c *rootTokenConfig) expiringSoon(now time.Time) bool {
+	return c.ExpiresOn != nil && c.ExpiresOn.Sub(now) < c.expiryWarningThreshold()
+}
+
+// extensionDue reports whether the root token should be extended at now. conf
+// may be nil if the connection does not exist.
+func (c *rootTokenConfig) extensionDue(now time.Time) bool {
+	return c != nil && c.AutoExtend && c.expiringSoon(now)
+}
+
+// setDetails records the details of the root token reported by cloudflare.
+func (c *rootTokenConfig) setDetails(token cloudflare.APIToken) {
+	c.Name = token.Name
+	c.Policies = token.Policies
+	c.Condition = token.Condition
+	c.NotBefore = token.NotBefore
+	c.ExpiresOn = token.ExpiresOn
+}
+
+// tokensWritePermissionGroup returns the permission group the root token
+// needs in order to create tokens.
+func (c *rootTokenConfig) tokensWritePermissionGroup() string {
+	if c.AccountID != "" {
+		return accountAPITokensWritePermissionGroup
+	}
+	return apiTokensWritePermissionGroup
+}
+
+// canWriteAPITokens reports whether token is allowed to create API tokens
+// through the given permission group.
+func canWriteAPITokens(token cloudflare.APIToken, permissionGroup string) bool {
+	for _, policy := range token.Policies {
+		if policy.Effect != "allow" {
+			continue
+		}
+		for _, group := range policy.PermissionGroups {
+			if group.Name == permissionGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rotationDue returns when the automatic rotation of the root token was due if
+// it is due at now, or the zero time otherwise. c may be nil if the
+// connection does not exist.
+func (c *rootTokenConfig) rotationDue(now time.Time) (time.Time, error) {
+	if c == nil || c.Token == "" {
+		return time.Time{}, nil
+	}
+
+	next, err := c.nextRotation(now)
+	if err != nil || next.IsZero() || now.Before(next) {
+		return time.Time{}, err
+	}
+	return next, nil
+}
+
+// nextRotation returns when the root token is next due for automatic
+// rotation. The zero time is returned if automatic rotation is disabled.
+func (c *rootTokenConfig) nextRotation(now time.Time) (time.Time, error) {
+	switch {
+	case c.RotationPeriod > 0:
+		return c.LastRotated.Add(c.RotationPeriod), nil
+	case c.RotationSchedule != "":
+		schedule, err := cron.ParseStandard(c.RotationSchedule)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid rotation_schedule %q: %w", c.RotationSchedule, err)
+		}
+		next := schedule.Next(c.LastRotated)
+		if c.RotationWindow == 0 || now.Before(next.Add(c.RotationWindow)) {
+			return next, nil
+		}
+
+		// the window of next was missed. the rotation is due at the most recent
+		// scheduled time that has passed if its window is still open, and at the
+		// scheduled time after it otherwise
+		latest := next
+		for t := schedule.Next(latest); !t.IsZero() && !t.After(now); t = schedule.Next(t) {
+			latest = t
+		}
+		if now.Before(latest.Add(c.RotationWindow)) {
+			return latest, nil
+		}
+		return schedule.Next(latest), nil
+	default:
+		return time.Time{}, nil
+	}
+}
+
+// maskToken hides all but the last four characters of token.
+func maskToken(token string) string {
+	const visible = 4
+	if len(token) <= visible {
+		return strings.Repeat("*", len(token))
+	}
+	return strings.Repeat("*", len(token)-visible) + token[len(token)-visible:]
+}
+
+// maskHeaders masks the values of headers with maskToken since they may carry
+// credentials, e.g. for a proxy.
+func maskHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+
+	masked := make(map[string]string, len(headers))
+	for k, v := range headers {
+		masked[k] = maskToken(v)
+	}
+	return masked
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatTimePtr(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return formatTime(*t)
 }
 
 const pathConfigTokenHelpSyn = `
@@ -135,8 +857,42 @@ Configure Cloudflare token and options used by vault
 const pathConfigTokenHelpDesc = `
 Will confugre this mount with the token used by Vault for all Cloudflare
 operations on this mount. Must be configured with: com.cloudflare.api.token.create.
+Mounts that can only use a Global API Key can set 'auth_type' to 'api_key'
+and provide 'email' and 'key' instead of 'token'. Such mounts can still issue
+scoped API tokens, but their root credential cannot be rotated by Vault. Write
+'auth_type=api_token' with a 'token' to migrate to a root token later.
+
+Reading this path only returns a masked suffix of the token (or key) unless
+'expose_token' was set in the same request that wrote it. The values of
+'headers' are always masked.
+
+Setting 'account_id' configures a root token owned by that account. It is
+managed through the account-owned token endpoints, needs the 'Account API
+Tokens Write' permission, and tokens issued with it are owned by the account
+rather than a user, so they keep working after the user leaves the account.
+
+The token is checked for the 'API Tokens Write' permission when it is written,
+and reading this path shows its name, policies, conditions and validity.
+
+Once the root token is within 'expiry_warning_threshold' of its expiry every
+response from this mount carries a warning. With 'auto_extend' set, the
+expiry is instead pushed forward by 'auto_extend_period' automatically.
 
 For instructions on how to get and/or create a cloudflare token see their
 documentation at https://developers.cloudflare.com/api/tokens/create. Cloudflare has
 a 'create api tokens' default template that can be used.
+
+The remaining options control how Vault reaches the Cloudflare API. Use
+'api_base_url' to point the mount at a different endpoint, 'proxy_url' and
+'ca_cert' to run behind an egress proxy or TLS-inspecting gateway, and
+'headers' to send additional static headers (for example to authenticate with
+the proxy) on every request.
+
+The root token can be rotated automatically by setting either
+'rotation_period' or a cron-style 'rotation_schedule' (optionally limited to a
+'rotation_window'). Reading this path reports when the token was last rotated
+and when the next rotation is due.
+
+The permission groups listed at 'permission-groups' are cached for
+'permission_groups_refresh_interval'.
 `
@@ -2,9 +2,7 @@ package cloudflare
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
@@ -12,25 +10,6 @@ import (
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
-// maxTokenNameLength is the maximum length for the name of a Nomad access
-// token
-const maxTokenNameLength = 120
-
-func createTokenName(role string) string {
-	lowerRole := strings.ToLower(role)
-
-	tokenName := fmt.Sprintf("vault-%s-%d", lowerRole, time.Now().UnixNano())
-
-	// Note: if the given role name is sufficiently long, the UnixNano() portion
-	// of the pseudo randomized token name is the part that gets trimmed off,
-	// weakening it's randomness.
-	if len(tokenName) > maxTokenNameLength {
-		tokenName = tokenName[:maxTokenNameLength]
-	}
-
-	return tokenName
-}
-
 func pathCredsCreate(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "creds/" + framework.GenericNameRegex("role"),
@@ -43,28 +22,59 @@ func pathCredsCreate(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "JSON-encoded cloudflare IP constraints to apply to the token. Useful for limiting token usage to the IP of a service. See https://api.cloudflare.com/#user-api-tokens-create-token for more information.",
 			},
+			"request_ip_in": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "IPv4 or IPv6 CIDRs the token may only be used from. An alternative to 'condition'",
+			},
+			"request_ip_not_in": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "IPv4 or IPv6 CIDRs the token may not be used from. An alternative to 'condition'",
+			},
+			"ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Requested lifetime of the token. Defaults to the ttl of the role and is limited to its max_ttl",
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.ReadOperation: b.pathCredsRead,
+			logical.ReadOperation:   b.pathCredsRead,
+			logical.UpdateOperation: b.pathCredsRead,
 		},
 	}
 }
 
 func (b *backend) pathCredsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	condition := cloudflare.APITokenCondition{}
-	policies := []cloudflare.APITokenPolicies{}
 	role := d.Get("role").(string)
 
+	requestIPIn, hasIn := d.GetOk("request_ip_in")
+	requestIPNotIn, hasNotIn := d.GetOk("request_ip_not_in")
 	if _, ok := d.GetOk("condition"); ok {
+		if hasIn || hasNotIn {
+			return logical.ErrorResponse("only one of 'condition' or 'request_ip_in' and 'request_ip_not_in' may be set"), nil
+		}
+
 		conditionRaw := d.Get("condition").(string)
 		if len(conditionRaw) > 0 {
-			err := json.Unmarshal([]byte(conditionRaw), &condition)
-
+			var err error
+			condition, err = parseCondition(conditionRaw)
 			if err != nil {
 				return logical.ErrorResponse(fmt.Sprintf("err while decoding 'condition'. err: %s", err)), nil
 			}
 		}
+	} else if hasIn || hasNotIn {
+		var in, notIn []string
+		if hasIn {
+			in = requestIPIn.([]string)
+		}
+		if hasNotIn {
+			notIn = requestIPNotIn.([]string)
+		}
+		var err error
+		condition, err = ipCondition(in, notIn)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid IP ranges. err: %s", err)), nil
+		}
 	}
 
 	roleEntry, err := b.roleRead(ctx, req.Storage, role)
@@ -75,35 +85,70 @@ func (b *backend) pathCredsRead(ctx context.Context, req *logical.Request, d *fr
 		return logical.ErrorResponse(fmt.Sprintf("could not find entry for role '%s', did you configure it?", role)), nil
 	}
 
-	if roleEntry.PolicyDocument != "" {
-		err = json.Unmarshal([]byte(roleEntry.PolicyDocument), &policies)
+	condition, err = roleEntry.narrowCondition(condition)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("'condition' may only narrow the condition of role '%s': %s", role, err)), nil
+	}
+	if roleEntry.BindToClientIP {
+		if req.Connection == nil || req.Connection.RemoteAddr == "" {
+			return logical.ErrorResponse(fmt.Sprintf("role '%s' binds tokens to the client's IP but the client's address is unknown", role)), nil
+		}
+		client, err := clientNetwork(req.Connection.RemoteAddr, roleEntry.ClientIPv4PrefixLength, roleEntry.ClientIPv6PrefixLength)
 		if err != nil {
-			return logical.ErrorResponse("failed to marshal '%s' into a list of cloudflare policies. ensure your configuration is correct", roleEntry.PolicyDocument), nil
+			return logical.ErrorResponse(fmt.Sprintf("failed to bind token to the client's IP: %s", err)), nil
 		}
+		condition, err = bindCondition(condition, client)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to bind token to the client's IP: %s", err)), nil
+		}
+	}
+
+	policies, err := roleEntry.policies()
+	if err != nil {
+		return logical.ErrorResponse("failed to marshal '%s' into a list of cloudflare policies. ensure your configuration is correct", roleEntry.PolicyDocument), nil
 	}
+	policies, err = b.renderPolicies(req, policies)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to render the policies of role '%s': %s", role, err)), nil
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 
 	// Get the http client
-	c, err := b.client(ctx, req.Storage)
+	c, err := b.client(ctx, req.Storage, roleEntry.Connection)
 	if err != nil {
 		return nil, err
 	}
+	if roleEntry.AccountID != "" {
+		c = c.forAccount(roleEntry.AccountID)
+	}
 
-	lease, err := b.LeaseConfig(ctx, req.Storage)
+	roleTTL, roleMaxTTL, err := b.roleTTLs(ctx, req.Storage, roleEntry)
 	if err != nil {
 		return nil, err
 	}
-	if lease == nil {
-		lease = &configLease{}
+
+	var requestedTTL time.Duration
+	if ttlRaw, ok := d.GetOk("ttl"); ok {
+		requestedTTL = time.Duration(ttlRaw.(int)) * time.Second
 	}
 
-	ttl, _, err := framework.CalculateTTL(b.System(), 0, lease.TTL, 0, lease.MaxTTL, 0, time.Time{})
+	// a requested ttl is treated like the increment of a renewal so it is
+	// limited to the max_ttl of the role or mount
+	ttl, _, err := framework.CalculateTTL(b.System(), requestedTTL, roleTTL, 0, roleMaxTTL, 0, time.Time{})
 	if err != nil {
 		return logical.ErrorResponse("failed to caluclate ttl. err: %s", err), nil
 	}
 
+	name, err := b.tokenName(ctx, req, role, roleEntry)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to generate the token name: %s", err)), nil
+	}
+
 	var expirationDate time.Time = time.Now().UTC().Add(ttl).Truncate(time.Second)
 	token := cloudflare.APIToken{
-		Name:      createTokenName(role),
+		Name:      name,
 		Policies:  policies,
 		Condition: &condition,
 		ExpiresOn: &expirationDate,
@@ -114,15 +159,40 @@ func (b *backend) pathCredsRead(ctx context.Context, req *logical.Request, d *fr
 		return logical.ErrorResponse("failed to create token. err: %s", err), nil
 	}
 
+	// the index is how connections know which tokens they still manage, so a
+	// token that cannot be indexed is deleted rather than handed out
+	if err := b.putTokenEntry(ctx, req.Storage, &cloudflareTokenEntry{
+		ID:         createdToken.ID,
+		Role:       role,
+		Name:       name,
+		Connection: roleEntry.Connection,
+		AccountID:  c.accountID,
+		EntityID:   req.EntityID,
+		IssuedAt:   time.Now().UTC().Truncate(time.Second),
+		ExpiresAt:  expirationDate,
+	}); err != nil {
+		if deleteErr := c.DeleteAPIToken(ctx, createdToken.ID); deleteErr != nil {
+			b.Logger().Error("failed to delete token that could not be indexed", "id", createdToken.ID, "error", deleteErr)
+			return nil, fmt.Errorf("failed to index token (%s): %w. deleting it also failed, please ensure it is deleted in cloudflare: %s", createdToken.ID, err, deleteErr)
+		}
+		return nil, fmt.Errorf("failed to index token (%s): %w", createdToken.ID, err)
+	}
+
 	// Use the helper to create the secret
 	resp := b.Secret(SecretTokenType).Response(map[string]interface{}{
 		"id":    createdToken.ID,
 		"token": createdToken.Value,
 	}, map[string]interface{}{
-		"id":    createdToken.ID,
-		"token": createdToken.Value,
+		"id":         createdToken.ID,
+		"token":      createdToken.Value,
+		"connection": roleEntry.Connection,
+		"account_id": c.accountID,
+		"role":       role,
 	})
-	resp.Secret.TTL = lease.TTL
-	resp.Secret.MaxTTL = lease.MaxTTL
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = roleMaxTTL
+	if requestedTTL > ttl {
+		resp.AddWarning(fmt.Sprintf("requested ttl of %s exceeds the max_ttl. the token was issued with a ttl of %s", requestedTTL, ttl))
+	}
 	return resp, nil
 }
@@ -0,0 +1,184 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// permissionGroupsPrefix is where the permission group catalog of each
+// connection is cached.
+const permissionGroupsPrefix = "permission-groups/"
+
+// defaultPermissionGroupsRefreshInterval is how long a cached permission group
+// catalog is used when 'permission_groups_refresh_interval' is not configured.
+const defaultPermissionGroupsRefreshInterval = 24 * time.Hour
+
+func pathPermissionGroups(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "permission-groups/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"connection": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the connection to list the permission groups of. Defaults to the connection configured at config/token",
+			},
+			"refresh": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, the permission groups are fetched from cloudflare even if the cached catalog is still fresh",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathPermissionGroupsRead,
+		},
+
+		HelpSynopsis:    pathPermissionGroupsHelpSyn,
+		HelpDescription: pathPermissionGroupsHelpDesc,
+	}
+}
+
+func (b *backend) pathPermissionGroupsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	catalog, err := b.permissionGroups(ctx, req.Storage, data.Get("connection").(string), data.Get("refresh").(bool))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	groups := make([]map[string]interface{}, 0, len(catalog.Groups))
+	for _, group := range catalog.Groups {
+		scopes := group.Scopes
+		if scopes == nil {
+			scopes = []string{}
+		}
+		groups = append(groups, map[string]interface{}{
+			"id":     group.ID,
+			"name":   group.Name,
+			"scopes": scopes,
+		})
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"permission_groups": groups,
+			"last_refreshed":    formatTime(catalog.LastRefreshed),
+		},
+	}, nil
+}
+
+// permissionGroupCatalog is the list of permission groups available to a
+// connection as last fetched from cloudflare.
+type permissionGroupCatalog struct {
+	Groups        []cloudflare.APITokenPermissionGroups `json:"groups"`
+	LastRefreshed time.Time                             `json:"last_refreshed"`
+
+	// fetched is set when the catalog was fetched from cloudflare rather than
+	// read from storage.
+	fetched bool
+}
+
+// find returns the permission group called name, ignoring case.
+func (c *permissionGroupCatalog) find(name string) (cloudflare.APITokenPermissionGroups, bool) {
+	for _, group := range c.Groups {
+		if strings.EqualFold(group.Name, name) {
+			return group, true
+		}
+	}
+	return cloudflare.APITokenPermissionGroups{}, false
+}
+
+// has reports whether the catalog contains a permission group with the given
+// ID.
+func (c *permissionGroupCatalog) has(id string) bool {
+	for _, group := range c.Groups {
+		if group.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionGroups returns the permission group catalog of the named
+// connection. The cached catalog is used until it is older than the
+// connection's refresh interval or refresh is set. Callers must hold b.lock
+// for reading.
+func (b *backend) permissionGroups(ctx context.Context, s logical.Storage, name string, refresh bool) (*permissionGroupCatalog, error) {
+	conf, err := b.readConnection(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		return nil, fmt.Errorf("connection '%s' does not exist. did you configure '%s'?", name, connectionPath(name))
+	}
+
+	key := permissionGroupsStorageKey(name)
+	if !refresh {
+		entry, err := s.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			var catalog permissionGroupCatalog
+			if err := entry.DecodeJSON(&catalog); err != nil {
+				return nil, err
+			}
+			if time.Since(catalog.LastRefreshed) < conf.permissionGroupsRefreshInterval() {
+				return &catalog, nil
+			}
+		}
+	}
+
+	c, err := b.client(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := c.ListAPITokensPermissionGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list permission groups: %w", err)
+	}
+
+	catalog := &permissionGroupCatalog{
+		Groups:        groups,
+		LastRefreshed: time.Now().UTC(),
+		fetched:       true,
+	}
+	entry, err := logical.StorageEntryJSON(key, catalog)
+	if err != nil {
+		return nil, err
+	}
+	// performance standbys cannot write to storage. they still answer with the
+	// fetched catalog and leave caching to the active node
+	if err := s.Put(ctx, entry); err != nil && !errors.Is(err, logical.ErrReadOnly) {
+		return nil, err
+	}
+
+	return catalog, nil
+}
+
+// permissionGroupsStorageKey returns the storage key the permission group
+// catalog of the named connection is cached at.
+func permissionGroupsStorageKey(name string) string {
+	return permissionGroupsPrefix + connectionPath(name)
+}
+
+const pathPermissionGroupsHelpSyn = `
+List the permission groups tokens can be granted.
+`
+
+const pathPermissionGroupsHelpDesc = `
+This path lists the ID, name and scopes of every permission group available to
+a connection, as reported by cloudflare's permission groups API. Use it to
+find the IDs to put in a role's 'policy_document'.
+
+The list is cached and fetched again once it is older than the connection's
+'permission_groups_refresh_interval' (24 hours by default). Set 'refresh' to
+fetch it immediately. Names in a role's 'permission_groups' are resolved
+against the same catalog.
+`
@@ -5,7 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/cloudflare/cloudflare-go"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
@@ -42,6 +45,82 @@ func pathRoles(b *backend) *framework.Path {
 				https://api.cloudflare.com/#user-api-tokens-create-token for more
 				information).`,
 			},
+
+			"connection": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the connection tokens generated from this role are created with. Defaults to the connection configured at config/token",
+			},
+
+			"account_id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the cloudflare account that owns tokens generated from this role. Defaults to the account_id of the role's connection. If neither is set, tokens are owned by the user of the root token",
+			},
+
+			"permission_groups": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Names of the permission groups (e.g. 'DNS Write') granted to tokens generated from this role. Together with 'zones' and 'account_ids' this is an alternative to 'policy_document'",
+			},
+
+			"zones": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Names of the zones the permission groups apply to",
+			},
+
+			"account_ids": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "IDs of the accounts the permission groups apply to",
+			},
+
+			"effect": &framework.FieldSchema{
+				Type:          framework.TypeString,
+				Description:   "Whether the permission groups are allowed or denied on the zones and accounts. Defaults to 'allow'",
+				AllowedValues: []interface{}{policyEffectAllow, policyEffectDeny},
+			},
+
+			"ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration before which tokens generated from this role need renewal. Defaults to the ttl of config/lease, then to the mount's default",
+			},
+
+			"max_ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration after which tokens generated from this role can no longer be renewed. Defaults to the max_ttl of config/lease, then to the mount's maximum",
+			},
+
+			"request_ip_in": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "CIDRs tokens generated from this role may only be used from. A 'condition' requested with the credentials can only narrow them",
+			},
+
+			"request_ip_not_in": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "CIDRs tokens generated from this role may never be used from, in addition to any requested with the credentials",
+			},
+
+			"bind_to_client_ip": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, tokens generated from this role can only be used from the address of the client that requested them",
+			},
+
+			"client_ipv4_prefix_length": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Prefix length the IPv4 address of the client is widened to when 'bind_to_client_ip' is set, between 1 and 32. Defaults to 32",
+			},
+
+			"client_ipv6_prefix_length": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Prefix length the IPv6 address of the client is widened to when 'bind_to_client_ip' is set, between 1 and 128. Defaults to 128",
+			},
+
+			"name_template": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Template for the names of tokens generated from this role. Defaults to the template configured at config/name-template",
+			},
+
+			"validate": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, a short-lived token is created and deleted to confirm cloudflare accepts the role's policies before it is saved",
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -82,9 +161,27 @@ func (b *backend) pathRolesRead(ctx context.Context, req *logical.Request, d *fr
 		return nil, nil
 	}
 
-	var respPolicy map[string]interface{}
-	inrec, _ := json.Marshal(entry)
-	json.Unmarshal(inrec, &respPolicy)
+	respPolicy, err := entry.responseData()
+	if err != nil {
+		return nil, err
+	}
+
+	// show what tokens are actually issued with after falling back to
+	// config/lease and the mount's tuning
+	ttl, maxTTL, err := b.roleTTLs(ctx, req.Storage, entry)
+	if err != nil {
+		return nil, err
+	}
+	effectiveTTL, _, err := framework.CalculateTTL(b.System(), 0, ttl, 0, maxTTL, 0, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	effectiveMaxTTL := b.System().MaxLeaseTTL()
+	if maxTTL > 0 && maxTTL < effectiveMaxTTL {
+		effectiveMaxTTL = maxTTL
+	}
+	respPolicy["effective_ttl"] = int64(effectiveTTL.Seconds())
+	respPolicy["effective_max_ttl"] = int64(effectiveMaxTTL.Seconds())
 
 	return &logical.Response{
 		Data: respPolicy,
@@ -118,17 +215,157 @@ func (b *backend) pathRolesWrite(ctx context.Context, req *logical.Request, d *f
 		roleEntry.PolicyDocument = policyDocument
 	}
 
-	var respData map[string]interface{}
-	marshalledRole, err := json.Marshal(roleEntry)
-	if err != nil {
-		return nil, err
+	if ttl, ok := d.GetOk("ttl"); ok {
+		roleEntry.TTL = time.Duration(ttl.(int)) * time.Second
+	}
+	if maxTTL, ok := d.GetOk("max_ttl"); ok {
+		roleEntry.MaxTTL = time.Duration(maxTTL.(int)) * time.Second
+	}
+	if roleEntry.TTL > 0 && roleEntry.MaxTTL > 0 && roleEntry.TTL > roleEntry.MaxTTL {
+		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	}
+
+	if accountID, ok := d.GetOk("account_id"); ok {
+		roleEntry.AccountID = accountID.(string)
+	}
+
+	if connection, ok := d.GetOk("connection"); ok {
+		roleEntry.Connection = connection.(string)
+		if roleEntry.Connection != "" {
+			conf, err := b.readConnection(ctx, req.Storage, roleEntry.Connection)
+			if err != nil {
+				return nil, err
+			}
+			if conf == nil {
+				return logical.ErrorResponse(fmt.Sprintf("connection '%s' does not exist", roleEntry.Connection)), nil
+			}
+		}
+	}
+
+	if requestIPIn, ok := d.GetOk("request_ip_in"); ok {
+		networks, err := parseCIDRs(requestIPIn.([]string))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid 'request_ip_in': %s", err)), nil
+		}
+		roleEntry.RequestIPIn = formatCIDRs(networks)
+	}
+	if requestIPNotIn, ok := d.GetOk("request_ip_not_in"); ok {
+		networks, err := parseCIDRs(requestIPNotIn.([]string))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid 'request_ip_not_in': %s", err)), nil
+		}
+		roleEntry.RequestIPNotIn = formatCIDRs(networks)
+	}
+
+	if bindToClientIP, ok := d.GetOk("bind_to_client_ip"); ok {
+		roleEntry.BindToClientIP = bindToClientIP.(bool)
 	}
-	err = json.Unmarshal([]byte(marshalledRole), &respData)
+	if prefixLength, ok := d.GetOk("client_ipv4_prefix_length"); ok {
+		roleEntry.ClientIPv4PrefixLength = prefixLength.(int)
+		if roleEntry.ClientIPv4PrefixLength < 1 || roleEntry.ClientIPv4PrefixLength > 32 {
+			return logical.ErrorResponse("'client_ipv4_prefix_length' must be between 1 and 32"), nil
+		}
+	}
+	if prefixLength, ok := d.GetOk("client_ipv6_prefix_length"); ok {
+		roleEntry.ClientIPv6PrefixLength = prefixLength.(int)
+		if roleEntry.ClientIPv6PrefixLength < 1 || roleEntry.ClientIPv6PrefixLength > 128 {
+			return logical.ErrorResponse("'client_ipv6_prefix_length' must be between 1 and 128"), nil
+		}
+	}
+
+	if nameTemplate, ok := d.GetOk("name_template"); ok {
+		roleEntry.NameTemplate = nameTemplate.(string)
+		if roleEntry.NameTemplate != "" {
+			if err := checkNameTemplate(roleEntry.NameTemplate); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("invalid 'name_template': %s", err)), nil
+			}
+		}
+	}
+
+	// only documents written by this request are checked, so roles stored
+	// before the checks were introduced can still be updated
+	if _, ok := d.GetOk("policy_document"); ok && roleEntry.PolicyDocument != "" {
+		b.lock.RLock()
+		problems, err := b.validatePolicyDocument(ctx, req.Storage, roleEntry.Connection, roleEntry.PolicyDocument)
+		b.lock.RUnlock()
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to validate policy document: %s", err)), nil
+		}
+		if len(problems) > 0 {
+			return logical.ErrorResponse(fmt.Sprintf("invalid policy document: %s", strings.Join(problems, "; "))), nil
+		}
+	}
+
+	if permissionGroups, ok := d.GetOk("permission_groups"); ok {
+		roleEntry.PermissionGroups = permissionGroups.([]string)
+	}
+	if zones, ok := d.GetOk("zones"); ok {
+		roleEntry.Zones = zones.([]string)
+	}
+	if accountIDs, ok := d.GetOk("account_ids"); ok {
+		roleEntry.AccountIDs = accountIDs.([]string)
+	}
+	if effect, ok := d.GetOk("effect"); ok {
+		roleEntry.Effect = effect.(string)
+		if roleEntry.Effect != "" && roleEntry.Effect != policyEffectAllow && roleEntry.Effect != policyEffectDeny {
+			return logical.ErrorResponse(fmt.Sprintf("invalid effect %q. must be one of '%s' or '%s'", roleEntry.Effect, policyEffectAllow, policyEffectDeny)), nil
+		}
+	}
+
+	if len(roleEntry.PermissionGroups) > 0 {
+		if roleEntry.PolicyDocument != "" {
+			return logical.ErrorResponse("only one of 'policy_document' or 'permission_groups' may be set"), nil
+		}
+		if len(roleEntry.Zones) == 0 && len(roleEntry.AccountIDs) == 0 {
+			return logical.ErrorResponse("'permission_groups' requires at least one of 'zones' or 'account_ids'"), nil
+		}
+
+		// resolving the names calls cloudflare, so the compiled policies are
+		// only rebuilt when something they are built from changes. writes
+		// that only change e.g. the ttl keep working while cloudflare is
+		// unavailable
+		recompile := len(roleEntry.Policies) == 0
+		for _, field := range []string{"permission_groups", "zones", "account_ids", "effect", "connection"} {
+			if _, ok := d.GetOk(field); ok {
+				recompile = true
+			}
+		}
+		if recompile {
+			b.lock.RLock()
+			roleEntry.Policies, err = b.compileRolePolicies(ctx, req.Storage, roleEntry)
+			b.lock.RUnlock()
+			if err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("failed to resolve 'permission_groups': %s", err)), nil
+			}
+		}
+	} else {
+		roleEntry.Policies = nil
+		if len(roleEntry.Zones) > 0 || len(roleEntry.AccountIDs) > 0 {
+			return logical.ErrorResponse("'zones' and 'account_ids' require 'permission_groups'"), nil
+		}
+	}
+
+	if d.Get("validate").(bool) {
+		b.lock.RLock()
+		problems, warnings, err := b.dryRunRole(ctx, req, roleName, roleEntry)
+		b.lock.RUnlock()
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("failed to validate role against cloudflare: %s", err)), nil
+		}
+		if len(problems) > 0 {
+			return logical.ErrorResponse(fmt.Sprintf("role was rejected by cloudflare: %s", strings.Join(problems, "; "))), nil
+		}
+		for _, warning := range warnings {
+			resp.AddWarning(warning)
+		}
+	}
+
+	respData, err := roleEntry.responseData()
 	if err != nil {
 		return nil, err
 	}
 
-	entry, err := logical.StorageEntryJSON("role/"+roleName, respData)
+	entry, err := logical.StorageEntryJSON("role/"+roleName, roleEntry)
 	if err != nil {
 		return nil, err
 	}
@@ -163,8 +400,100 @@ func (b *backend) roleRead(ctx context.Context, s logical.Storage, roleName stri
 	return nil, nil
 }
 
+// roleTTLs returns the ttl and max_ttl of tokens generated from role. Values
+// the role does not set fall back to config/lease; zero values that remain
+// are resolved from the mount's tuning by framework.CalculateTTL. role may be
+// nil, e.g. when renewing a token whose role was deleted.
+func (b *backend) roleTTLs(ctx context.Context, s logical.Storage, role *cloudflareRoleEntry) (time.Duration, time.Duration, error) {
+	lease, err := b.LeaseConfig(ctx, s)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lease == nil {
+		lease = &configLease{}
+	}
+
+	ttl, maxTTL := lease.TTL, lease.MaxTTL
+	if role != nil && role.TTL > 0 {
+		ttl = role.TTL
+	}
+	if role != nil && role.MaxTTL > 0 {
+		maxTTL = role.MaxTTL
+	}
+
+	return ttl, maxTTL, nil
+}
+
 type cloudflareRoleEntry struct {
-	PolicyDocument string `json:"policy_document"` // JSON-serialized inline policy to attach to tokens.
+	PolicyDocument string `json:"policy_document"`      // JSON-serialized inline policy to attach to tokens.
+	Connection     string `json:"connection,omitempty"` // Name of the connection tokens are created with.
+	AccountID      string `json:"account_id,omitempty"` // ID of the account that owns tokens, overriding the connection's.
+
+	TTL    time.Duration `json:"ttl,omitempty"`     // Overrides the ttl of config/lease.
+	MaxTTL time.Duration `json:"max_ttl,omitempty"` // Overrides the max_ttl of config/lease.
+
+	// IP condition every token generated from the role carries. Callers can
+	// only narrow it.
+	RequestIPIn    []string `json:"request_ip_in,omitempty"`
+	RequestIPNotIn []string `json:"request_ip_not_in,omitempty"`
+
+	// Limits tokens to the network of the client that requested them.
+	BindToClientIP         bool `json:"bind_to_client_ip,omitempty"`
+	ClientIPv4PrefixLength int  `json:"client_ipv4_prefix_length,omitempty"`
+	ClientIPv6PrefixLength int  `json:"client_ipv6_prefix_length,omitempty"`
+
+	NameTemplate string `json:"name_template,omitempty"` // Overrides the template of config/name-template.
+
+	// Structured alternative to PolicyDocument, compiled into Policies when the
+	// role is written.
+	PermissionGroups []string                      `json:"permission_groups,omitempty"`
+	Zones            []string                      `json:"zones,omitempty"`
+	AccountIDs       []string                      `json:"account_ids,omitempty"`
+	Effect           string                        `json:"effect,omitempty"`
+	Policies         []cloudflare.APITokenPolicies `json:"policies,omitempty"`
+}
+
+func (r *cloudflareRoleEntry) effect() string {
+	if r.Effect == "" {
+		return policyEffectAllow
+	}
+	return r.Effect
+}
+
+// policies returns the cloudflare policies tokens generated from the role
+// inherit, either compiled from its structured fields or parsed from its
+// policy document.
+func (r *cloudflareRoleEntry) policies() ([]cloudflare.APITokenPolicies, error) {
+	if len(r.PermissionGroups) > 0 {
+		return r.Policies, nil
+	}
+
+	policies := []cloudflare.APITokenPolicies{}
+	if r.PolicyDocument == "" {
+		return policies, nil
+	}
+	if err := json.Unmarshal([]byte(r.PolicyDocument), &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// responseData returns the role as it is shown in responses, with durations
+// in seconds.
+func (r *cloudflareRoleEntry) responseData() (map[string]interface{}, error) {
+	var data map[string]interface{}
+	marshalledRole, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(marshalledRole, &data); err != nil {
+		return nil, err
+	}
+
+	data["ttl"] = int64(r.TTL.Seconds())
+	data["max_ttl"] = int64(r.MaxTTL.Seconds())
+
+	return data, nil
 }
 
 func compactJSON(input string) (string, error) {
@@ -191,6 +520,39 @@ then a user could request access credentials at "cloudflare/creds/deploy".
 You can submit policies inline using a policy on disk (see Vault
 documentation for more information
 (https://www.vaultproject.io/docs/commands/write#examples)) or by submitting
-a compact JSON as a value. Policies are only syntatically validated on write.
-To validate the keys, attempt to read token after writing the policy.
+a compact JSON as a value. Policies are validated on write: unknown fields,
+effects other than 'allow' or 'deny', malformed resource keys and permission
+group IDs missing from the connection's permission-groups catalog are all
+reported along with their JSON path. To confirm cloudflare itself accepts
+the policies, write to "roles/<name>/validate" or set 'validate' when writing
+the role.
+
+Tokens generated from a role use its 'ttl' and 'max_ttl' if set, otherwise
+those of config/lease, and otherwise the mount's defaults. Reading a role
+shows the resulting 'effective_ttl' and 'effective_max_ttl'.
+
+Instead of a policy document, a role can list the names of the permission
+groups it grants in 'permission_groups' along with the 'zones' (by name) and
+'account_ids' they apply to. They are resolved through the role's connection
+whenever one of these fields, 'effect' or 'connection' is written and the
+resulting cloudflare policy is shown in 'policies'.
+
+'request_ip_in' and 'request_ip_not_in' restrict where tokens generated from
+the role can be used from. A 'condition' requested with the credentials may
+only narrow them: the ranges it allows must lie within 'request_ip_in' and the
+ranges in 'request_ip_not_in' are always excluded.
+
+Resource keys and permission group IDs in 'policy_document', as well as
+'account_ids', may contain identity templates such as
+{{identity.entity.metadata.zone}}. They are rendered for the entity requesting
+credentials, so a single role can issue tokens scoped to each team's own
+zones.
+
+Tokens are named after 'name_template' if set, otherwise after the template
+configured at config/name-template.
+
+With 'bind_to_client_ip' set, tokens can only be used from the address of the
+client that requested them, optionally widened to
+'client_ipv4_prefix_length' or 'client_ipv6_prefix_length'. The client address
+must lie within the role's (and the requested) ranges.
 `
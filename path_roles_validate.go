@@ -0,0 +1,169 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// dryRunTokenTTL is the lifetime of the tokens created to validate a role.
+// They are deleted right away, the expiry only bounds how long one stays
+// usable if the deletion fails.
+const dryRunTokenTTL = time.Minute
+
+func pathRoleValidate(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameWithAtRegex("name") + "/validate",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the role to validate",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathRoleValidate,
+		},
+
+		HelpSynopsis:    pathRoleValidateHelpSyn,
+		HelpDescription: pathRoleValidateHelpDesc,
+	}
+}
+
+func (b *backend) pathRoleValidate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName := d.Get("name").(string)
+	roleEntry, err := b.roleRead(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if roleEntry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("could not find entry for role '%s', did you configure it?", roleName)), nil
+	}
+
+	b.lock.RLock()
+	problems, warnings, err := b.dryRunRole(ctx, req, roleName, roleEntry)
+	b.lock.RUnlock()
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("failed to validate role against cloudflare: %s", err)), nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{"valid": len(problems) == 0},
+	}
+	if len(problems) > 0 {
+		resp = logical.ErrorResponse(fmt.Sprintf("role was rejected by cloudflare: %s", strings.Join(problems, "; ")))
+	}
+	for _, warning := range warnings {
+		resp.AddWarning(warning)
+	}
+
+	return resp, nil
+}
+
+// dryRunRole creates a short-lived token with the policies of role to confirm
+// cloudflare accepts them and deletes it again. The errors cloudflare reports
+// are returned as problems, mapped to the JSON path of the policy entry they
+// refer to where possible. Identity templates are rendered for the entity
+// that made req. Callers must hold b.lock for reading.
+func (b *backend) dryRunRole(ctx context.Context, req *logical.Request, roleName string, role *cloudflareRoleEntry) ([]string, []string, error) {
+	policies, err := role.policies()
+	if err != nil {
+		return nil, nil, err
+	}
+	policies, err = b.renderPolicies(req, policies)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := b.client(ctx, req.Storage, role.Connection)
+	if err != nil {
+		return nil, nil, err
+	}
+	if role.AccountID != "" {
+		c = c.forAccount(role.AccountID)
+	}
+
+	name, err := b.tokenName(ctx, req, "validate-"+roleName, role)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expiresOn := time.Now().UTC().Add(dryRunTokenTTL).Truncate(time.Second)
+	created, err := c.CreateAPIToken(ctx, cloudflare.APIToken{
+		Name:      name,
+		Policies:  policies,
+		ExpiresOn: &expiresOn,
+	})
+	if err != nil {
+		var apiErr *cloudflare.APIRequestError
+		if errors.As(err, &apiErr) && apiErr.ClientError() {
+			return policyErrorPaths(policies, apiErr.Errors), nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var warnings []string
+	if err := c.DeleteAPIToken(ctx, created.ID); err != nil {
+		b.Logger().Warn("failed to delete validation token", "id", created.ID, "error", err)
+		warnings = append(warnings, fmt.Sprintf("failed to delete the validation token (%s). it expires at %s. err: %s", created.ID, expiresOn.Format(time.RFC3339), err))
+	}
+
+	return nil, warnings, nil
+}
+
+// policyErrorPaths prefixes each of the errors cloudflare reported for
+// policies with the JSON path of every permission group or resource it
+// mentions. Errors that mention neither are reported against the whole list.
+func policyErrorPaths(policies []cloudflare.APITokenPolicies, errs []cloudflare.ResponseInfo) []string {
+	var problems []string
+	for _, e := range errs {
+		var paths []string
+		for i, policy := range policies {
+			for j, group := range policy.PermissionGroups {
+				if group.ID != "" && strings.Contains(e.Message, group.ID) {
+					paths = append(paths, fmt.Sprintf("$[%d].permission_groups[%d].id", i, j))
+				}
+			}
+
+			var resources []string
+			for resource := range policy.Resources {
+				resources = append(resources, resource)
+			}
+			sort.Strings(resources)
+			for _, resource := range resources {
+				if strings.Contains(e.Message, resource) {
+					paths = append(paths, fmt.Sprintf("$[%d].resources[%q]", i, resource))
+				}
+			}
+		}
+		if len(paths) == 0 {
+			paths = []string{"$"}
+		}
+
+		for _, path := range paths {
+			problems = append(problems, fmt.Sprintf("%s: %s (%d)", path, e.Message, e.Code))
+		}
+	}
+	return problems
+}
+
+const pathRoleValidateHelpSyn = `
+Check that cloudflare accepts the policies of a role.
+`
+
+const pathRoleValidateHelpDesc = `
+Writing to this path creates a token with the policies of the role, confirms
+cloudflare accepts it and deletes it again, without creating a lease. The
+token expires after a minute in case it cannot be deleted.
+
+Errors reported by cloudflare are mapped back to the JSON path of the policy
+entry they refer to. Roles can also be validated this way when they are
+written by setting 'validate'.
+`
@@ -0,0 +1,172 @@
+package cloudflare
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// tokenPrefix holds an index entry for every token issued by the mount that
+// has not been revoked yet, keyed by the token's ID.
+const tokenPrefix = "tokens/"
+
+func pathListTokens(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tokens/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Only list the tokens issued from this role",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathTokenList,
+		},
+
+		HelpSynopsis:    pathListTokensHelpSyn,
+		HelpDescription: pathListTokensHelpDesc,
+	}
+}
+
+func pathTokens(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tokens/" + framework.GenericNameRegex("id"),
+		Fields: map[string]*framework.FieldSchema{
+			"id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the cloudflare token",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathTokenRead,
+		},
+
+		HelpSynopsis:    pathTokensHelpSyn,
+		HelpDescription: pathTokensHelpDesc,
+	}
+}
+
+func (b *backend) pathTokenList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	ids, err := req.Storage.List(ctx, tokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	role := d.Get("role").(string)
+	keys := make([]string, 0, len(ids))
+	keyInfo := make(map[string]interface{}, len(ids))
+	for _, id := range ids {
+		entry, err := b.tokenEntry(ctx, req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+		// the token may have been revoked since it was listed
+		if entry == nil || (role != "" && entry.Role != role) {
+			continue
+		}
+
+		keys = append(keys, id)
+		keyInfo[id] = map[string]interface{}{
+			"role":       entry.Role,
+			"name":       entry.Name,
+			"expires_at": formatTime(entry.ExpiresAt),
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func (b *backend) pathTokenRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := b.tokenEntry(ctx, req.Storage, d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"id":         entry.ID,
+			"role":       entry.Role,
+			"name":       entry.Name,
+			"connection": entry.Connection,
+			"account_id": entry.AccountID,
+			"entity_id":  entry.EntityID,
+			"issued_at":  formatTime(entry.IssuedAt),
+			"expires_at": formatTime(entry.ExpiresAt),
+		},
+	}, nil
+}
+
+func (b *backend) tokenEntry(ctx context.Context, s logical.Storage, id string) (*cloudflareTokenEntry, error) {
+	entry, err := s.Get(ctx, tokenPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result cloudflareTokenEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) putTokenEntry(ctx context.Context, s logical.Storage, token *cloudflareTokenEntry) error {
+	entry, err := logical.StorageEntryJSON(tokenPrefix+token.ID, token)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// extendTokenEntry records the new expiry of a renewed token. Tokens issued
+// before the index existed have no entry and are left alone.
+func (b *backend) extendTokenEntry(ctx context.Context, s logical.Storage, id string, expiresAt time.Time) error {
+	token, err := b.tokenEntry(ctx, s, id)
+	if err != nil || token == nil {
+		return err
+	}
+
+	token.ExpiresAt = expiresAt
+	return b.putTokenEntry(ctx, s, token)
+}
+
+// cloudflareTokenEntry is the index entry of an issued token. It never holds
+// the token's value, which only lives in the lease.
+type cloudflareTokenEntry struct {
+	ID         string    `json:"id"`
+	Role       string    `json:"role"`
+	Name       string    `json:"name"`
+	Connection string    `json:"connection,omitempty"`
+	AccountID  string    `json:"account_id,omitempty"`
+	EntityID   string    `json:"entity_id,omitempty"`
+	IssuedAt   time.Time `json:"issued_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+const pathListTokensHelpSyn = `List the cloudflare tokens issued by this mount`
+
+const pathListTokensHelpDesc = `Tokens will be listed by their ID, along with the
+role they were issued from, their name and when they expire. Set 'role' to only
+list the tokens of one role. Tokens are removed from the list once their lease
+is revoked.
+`
+
+const pathTokensHelpSyn = `
+Read the record of an issued cloudflare token.
+`
+
+const pathTokensHelpDesc = `
+Every token issued from 'creds/' is recorded with its role, name, connection,
+the entity that requested it and when it was issued and expires. The token's
+value is not recorded.
+`
@@ -0,0 +1,348 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	policyEffectAllow = "allow"
+	policyEffectDeny  = "deny"
+)
+
+// Prefixes of the resource keys cloudflare policies grant access to.
+const (
+	accountResourcePrefix = "com.cloudflare.api.account."
+	zoneResourcePrefix    = "com.cloudflare.api.account.zone."
+	userResourcePrefix    = "com.cloudflare.api.user."
+)
+
+// resourceIDRegex matches the ID (or wildcard) at the end of a resource key.
+var resourceIDRegex = regexp.MustCompile(`^(\*|[0-9A-Za-z_-]+)$`)
+
+// compileRolePolicies resolves the permission group names, zone names and
+// account IDs of role into the cloudflare policy they describe. Permission
+// groups are looked up in the permission group catalog of the role's
+// connection and zones with cloudflare's zones API, so the compiled policy
+// refers to both by ID. Callers must hold b.lock for reading.
+func (b *backend) compileRolePolicies(ctx context.Context, s logical.Storage, role *cloudflareRoleEntry) ([]cloudflare.APITokenPolicies, error) {
+	catalog, err := b.permissionGroups(ctx, s, role.Connection, false)
+	if err != nil {
+		return nil, err
+	}
+	groups, unknown := resolvePermissionGroups(catalog, role.PermissionGroups)
+	if len(unknown) > 0 && !catalog.fetched {
+		// the cached catalog may predate a permission group cloudflare added
+		// since, so look again before giving up
+		catalog, err = b.permissionGroups(ctx, s, role.Connection, true)
+		if err != nil {
+			return nil, err
+		}
+		groups, unknown = resolvePermissionGroups(catalog, role.PermissionGroups)
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown permission groups: %s", strings.Join(unknown, ", "))
+	}
+
+	policy := cloudflare.APITokenPolicies{
+		Effect:           role.effect(),
+		Resources:        make(map[string]interface{}),
+		PermissionGroups: groups,
+	}
+
+	c, err := b.client(ctx, s, role.Connection)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range role.Zones {
+		zones, err := c.ListZonesContext(ctx, cloudflare.WithZoneFilters(name, "", ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up zone %q: %w", name, err)
+		}
+		switch len(zones.Result) {
+		case 0:
+			return nil, fmt.Errorf("zone %q could not be found", name)
+		case 1:
+			policy.Resources[zoneResourcePrefix+zones.Result[0].ID] = "*"
+		default:
+			return nil, fmt.Errorf("zone name %q is ambiguous. it matches %d zones", name, len(zones.Result))
+		}
+	}
+
+	for _, accountID := range role.AccountIDs {
+		policy.Resources[accountResourcePrefix+accountID] = "*"
+	}
+
+	return []cloudflare.APITokenPolicies{policy}, nil
+}
+
+// resolvePermissionGroups looks up the permission groups called names in
+// catalog and returns them along with the names that could not be found.
+func resolvePermissionGroups(catalog *permissionGroupCatalog, names []string) ([]cloudflare.APITokenPermissionGroups, []string) {
+	var groups []cloudflare.APITokenPermissionGroups
+	var unknown []string
+	for _, name := range names {
+		group, ok := catalog.find(name)
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		groups = append(groups, cloudflare.APITokenPermissionGroups{
+			ID:   group.ID,
+			Name: group.Name,
+		})
+	}
+	return groups, unknown
+}
+
+// validatePolicyDocument checks that document is a list of cloudflare policies
+// whose permission groups are known to the named connection. Every problem is
+// returned, prefixed with the JSON path it was found at. Permission group IDs
+// are only checked once the connection is configured. Callers must hold
+// b.lock for reading.
+func (b *backend) validatePolicyDocument(ctx context.Context, s logical.Storage, connection, document string) ([]string, error) {
+	conf, err := b.readConnection(ctx, s, connection)
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		problems, _ := checkPolicyDocument(document, nil)
+		return problems, nil
+	}
+
+	catalog, err := b.permissionGroups(ctx, s, connection, false)
+	if err != nil {
+		return nil, err
+	}
+	problems, unknownGroups := checkPolicyDocument(document, catalog)
+	if unknownGroups && !catalog.fetched {
+		catalog, err = b.permissionGroups(ctx, s, connection, true)
+		if err != nil {
+			return nil, err
+		}
+		problems, _ = checkPolicyDocument(document, catalog)
+	}
+	return problems, nil
+}
+
+// checkPolicyDocument returns the problems found in document and whether any
+// of them is a permission group ID missing from catalog. catalog may be nil to
+// skip checking the IDs.
+func checkPolicyDocument(document string, catalog *permissionGroupCatalog) ([]string, bool) {
+	c := &policyChecker{catalog: catalog}
+
+	var policies []json.RawMessage
+	if err := json.Unmarshal([]byte(document), &policies); err != nil {
+		c.addf("$", "must be a list of policies")
+		return c.problems, false
+	}
+	for i, raw := range policies {
+		c.checkPolicy(fmt.Sprintf("$[%d]", i), raw)
+	}
+	return c.problems, c.unknownGroups
+}
+
+type policyChecker struct {
+	catalog       *permissionGroupCatalog
+	problems      []string
+	unknownGroups bool
+}
+
+func (c *policyChecker) addf(path, format string, args ...interface{}) {
+	c.problems = append(c.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// object decodes raw as a JSON object, reporting fields other than allowed.
+func (c *policyChecker) object(path string, raw json.RawMessage, allowed ...string) (map[string]json.RawMessage, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		c.addf(path, "must be an object")
+		return nil, false
+	}
+	for _, key := range sortedKeys(fields) {
+		if !strutil.StrListContains(allowed, key) {
+			c.addf(path+"."+key, "unknown field")
+		}
+	}
+	return fields, true
+}
+
+func (c *policyChecker) checkPolicy(path string, raw json.RawMessage) {
+	fields, ok := c.object(path, raw, "id", "effect", "resources", "permission_groups")
+	if !ok {
+		return
+	}
+
+	if id, ok := fields["id"]; ok {
+		var value string
+		if err := json.Unmarshal(id, &value); err != nil {
+			c.addf(path+".id", "must be a string")
+		}
+	}
+
+	if effect, ok := fields["effect"]; !ok {
+		c.addf(path+".effect", "is required")
+	} else {
+		var value string
+		if err := json.Unmarshal(effect, &value); err != nil || (value != policyEffectAllow && value != policyEffectDeny) {
+			c.addf(path+".effect", "must be one of '%s' or '%s'", policyEffectAllow, policyEffectDeny)
+		}
+	}
+
+	if resources, ok := fields["resources"]; !ok {
+		c.addf(path+".resources", "is required")
+	} else {
+		c.checkResources(path+".resources", resources)
+	}
+
+	if groups, ok := fields["permission_groups"]; !ok {
+		c.addf(path+".permission_groups", "is required")
+	} else {
+		c.checkPermissionGroups(path+".permission_groups", groups)
+	}
+}
+
+// checkResources checks the resources of a policy. Keys refer to a user, an
+// account or a zone by ID (or '*' for all of them). Values are '*', or for an
+// account, an object of the zones in it the policy is limited to.
+func (c *policyChecker) checkResources(path string, raw json.RawMessage) {
+	var resources map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &resources); err != nil || resources == nil {
+		c.addf(path, "must be an object")
+		return
+	}
+	if len(resources) == 0 {
+		c.addf(path, "must not be empty")
+	}
+
+	for _, key := range sortedKeys(resources) {
+		keyPath := fmt.Sprintf("%s[%q]", path, key)
+		value := resources[key]
+		c.checkTemplate(keyPath, key)
+
+		switch {
+		case strings.HasPrefix(key, zoneResourcePrefix):
+			c.checkResourceID(keyPath, strings.TrimPrefix(key, zoneResourcePrefix))
+			c.checkWildcard(keyPath, value)
+		case strings.HasPrefix(key, accountResourcePrefix):
+			c.checkResourceID(keyPath, strings.TrimPrefix(key, accountResourcePrefix))
+
+			var zones map[string]json.RawMessage
+			if err := json.Unmarshal(value, &zones); err != nil || zones == nil {
+				c.checkWildcard(keyPath, value)
+				continue
+			}
+			for _, zone := range sortedKeys(zones) {
+				zonePath := fmt.Sprintf("%s[%q]", keyPath, zone)
+				c.checkTemplate(zonePath, zone)
+				if !strings.HasPrefix(zone, zoneResourcePrefix) {
+					c.addf(zonePath, "must be a zone resource starting with '%s'", zoneResourcePrefix)
+					continue
+				}
+				c.checkResourceID(zonePath, strings.TrimPrefix(zone, zoneResourcePrefix))
+				c.checkWildcard(zonePath, zones[zone])
+			}
+		case strings.HasPrefix(key, userResourcePrefix):
+			c.checkResourceID(keyPath, strings.TrimPrefix(key, userResourcePrefix))
+			c.checkWildcard(keyPath, value)
+		default:
+			c.addf(keyPath, "must start with one of '%s', '%s' or '%s'", accountResourcePrefix, zoneResourcePrefix, userResourcePrefix)
+		}
+	}
+}
+
+// checkTemplate reports malformed identity templates in s.
+func (c *policyChecker) checkTemplate(path, s string) {
+	if !isIdentityTemplate(s) {
+		return
+	}
+	if err := checkIdentityTemplate(s); err != nil {
+		c.addf(path, "invalid identity template: %s", err)
+	}
+}
+
+// checkResourceID checks the ID at the end of a resource key. IDs rendered
+// from identity templates are checked when the credentials are created.
+func (c *policyChecker) checkResourceID(path, id string) {
+	if isIdentityTemplate(id) {
+		return
+	}
+	if !resourceIDRegex.MatchString(id) {
+		c.addf(path, "must end in an ID or '*'")
+	}
+}
+
+func (c *policyChecker) checkWildcard(path string, raw json.RawMessage) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil || value != "*" {
+		c.addf(path, "must be \"*\"")
+	}
+}
+
+func (c *policyChecker) checkPermissionGroups(path string, raw json.RawMessage) {
+	var groups []json.RawMessage
+	if err := json.Unmarshal(raw, &groups); err != nil {
+		c.addf(path, "must be a list")
+		return
+	}
+	if len(groups) == 0 {
+		c.addf(path, "must not be empty")
+	}
+
+	for i, group := range groups {
+		groupPath := fmt.Sprintf("%s[%d]", path, i)
+		fields, ok := c.object(groupPath, group, "id", "name", "scopes")
+		if !ok {
+			continue
+		}
+
+		if name, ok := fields["name"]; ok {
+			var value string
+			if err := json.Unmarshal(name, &value); err != nil {
+				c.addf(groupPath+".name", "must be a string")
+			}
+		}
+		if scopes, ok := fields["scopes"]; ok {
+			var value []string
+			if err := json.Unmarshal(scopes, &value); err != nil {
+				c.addf(groupPath+".scopes", "must be a list of strings")
+			}
+		}
+
+		id, ok := fields["id"]
+		if !ok {
+			c.addf(groupPath+".id", "is required")
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(id, &value); err != nil || value == "" {
+			c.addf(groupPath+".id", "must be a non-empty string")
+			continue
+		}
+		if isIdentityTemplate(value) {
+			c.checkTemplate(groupPath+".id", value)
+			continue
+		}
+		if c.catalog != nil && !c.catalog.has(value) {
+			c.addf(groupPath+".id", "unknown permission group %q", value)
+			c.unknownGroups = true
+		}
+	}
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
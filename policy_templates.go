@@ -0,0 +1,143 @@
+package cloudflare
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// isIdentityTemplate reports whether s contains identity templating
+// directives such as {{identity.entity.metadata.zone}}.
+func isIdentityTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// checkIdentityTemplate returns an error if the templating directives in s
+// are malformed.
+func checkIdentityTemplate(s string) error {
+	_, _, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+		String:            s,
+		ValidityCheckOnly: true,
+		Mode:              identitytpl.ACLTemplating,
+	})
+	return err
+}
+
+// renderPolicies renders the identity templates in policies for the entity
+// that made req. Policies without templates are returned unchanged. The
+// rendered policies are checked again so entity metadata cannot widen them,
+// e.g. by rendering a wildcard resource.
+func (b *backend) renderPolicies(req *logical.Request, policies []cloudflare.APITokenPolicies) ([]cloudflare.APITokenPolicies, error) {
+	marshalled, err := json.Marshal(policies)
+	if err != nil {
+		return nil, err
+	}
+	if !isIdentityTemplate(string(marshalled)) {
+		return policies, nil
+	}
+
+	if req.EntityID == "" {
+		return nil, fmt.Errorf("the policies use identity templates but the request has no identity entity")
+	}
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up entity %q: %w", req.EntityID, err)
+	}
+	if entity == nil {
+		return nil, fmt.Errorf("entity %q could not be found", req.EntityID)
+	}
+	groups, err := b.System().GroupsForEntity(req.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the groups of entity %q: %w", req.EntityID, err)
+	}
+
+	r := &policyRenderer{entity: entity, groups: groups}
+	rendered := make([]cloudflare.APITokenPolicies, 0, len(policies))
+	for _, policy := range policies {
+		resources, err := r.resources(policy.Resources)
+		if err != nil {
+			return nil, err
+		}
+		policy.Resources = resources
+
+		groups := make([]cloudflare.APITokenPermissionGroups, 0, len(policy.PermissionGroups))
+		for _, group := range policy.PermissionGroups {
+			if group.ID, err = r.render(group.ID); err != nil {
+				return nil, err
+			}
+			groups = append(groups, group)
+		}
+		policy.PermissionGroups = groups
+
+		rendered = append(rendered, policy)
+	}
+
+	marshalled, err = json.Marshal(rendered)
+	if err != nil {
+		return nil, err
+	}
+	if problems, _ := checkPolicyDocument(string(marshalled), nil); len(problems) > 0 {
+		return nil, fmt.Errorf("the rendered policies are invalid: %s", strings.Join(problems, "; "))
+	}
+
+	return rendered, nil
+}
+
+type policyRenderer struct {
+	entity *logical.Entity
+	groups []*logical.Group
+}
+
+func (r *policyRenderer) render(s string) (string, error) {
+	if !isIdentityTemplate(s) {
+		return s, nil
+	}
+
+	_, rendered, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+		String:      s,
+		Entity:      r.entity,
+		Groups:      r.groups,
+		NamespaceID: r.entity.NamespaceID,
+		Mode:        identitytpl.ACLTemplating,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render %q: %w", s, err)
+	}
+	if strings.Count(rendered, "*") != strings.Count(s, "*") {
+		return "", fmt.Errorf("rendering %q produced a wildcard", s)
+	}
+	return rendered, nil
+}
+
+// resources renders the keys and values of a policy's resources, including
+// the zones nested under an account.
+func (r *policyRenderer) resources(resources map[string]interface{}) (map[string]interface{}, error) {
+	rendered := make(map[string]interface{}, len(resources))
+	for key, value := range resources {
+		renderedKey, err := r.render(key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := value.(type) {
+		case string:
+			if value, err = r.render(v); err != nil {
+				return nil, err
+			}
+		case map[string]interface{}:
+			if value, err = r.resources(v); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, ok := rendered[renderedKey]; ok {
+			return nil, fmt.Errorf("rendering %q produced the duplicate resource %q", key, renderedKey)
+		}
+		rendered[renderedKey] = value
+	}
+	return rendered, nil
+}
@@ -36,28 +36,44 @@ func secretToken(b *backend) *framework.Secret {
 }
 
 func (b *backend) secretTokenRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	c, err := b.client(ctx, req.Storage)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	// leases issued before connections existed were always created with the
+	// connection configured at config/token
+	connection, _ := req.Secret.InternalData["connection"].(string)
+	c, err := b.client(ctx, req.Storage, connection)
 	if err != nil {
 		return nil, err
 	}
 	if c == nil {
 		return nil, fmt.Errorf("error getting cloudflare client")
 	}
-
-	lease, err := b.LeaseConfig(ctx, req.Storage)
+	// the token is managed through the endpoints of whoever owned it when it
+	// was issued, which may differ from the connection's current account_id
+	accountID, _ := req.Secret.InternalData["account_id"].(string)
+	c = c.forAccount(accountID)
+
+	// the ttls of the role are used while it exists. leases issued before the
+	// role was recorded, or whose role was deleted, fall back to config/lease
+	var roleEntry *cloudflareRoleEntry
+	if role, _ := req.Secret.InternalData["role"].(string); role != "" {
+		roleEntry, err = b.roleRead(ctx, req.Storage, role)
+		if err != nil {
+			return nil, err
+		}
+	}
+	roleTTL, roleMaxTTL, err := b.roleTTLs(ctx, req.Storage, roleEntry)
 	if err != nil {
 		return nil, err
 	}
-	if lease == nil {
-		lease = &configLease{}
-	}
 
 	id, ok := req.Secret.InternalData["id"]
 	if !ok {
 		return nil, fmt.Errorf("id is missing on the lease")
 	}
 
-	ttl, _, err := framework.CalculateTTL(b.System(), req.Secret.Increment, lease.TTL, 0, lease.MaxTTL, 0, req.Secret.IssueTime)
+	ttl, _, err := framework.CalculateTTL(b.System(), req.Secret.Increment, roleTTL, 0, roleMaxTTL, 0, req.Secret.IssueTime)
 	if err != nil {
 		return logical.ErrorResponse("failed to caluclate ttl. err: %s", err), nil
 	}
@@ -68,27 +84,50 @@ func (b *backend) secretTokenRenew(ctx context.Context, req *logical.Request, d
 	if ttl > 0 {
 		expirationDate = expirationDate.Add(ttl).Add(time.Minute * 1)
 	}
-	updatedAPIToken := cloudflare.APIToken{ExpiresOn: &expirationDate}
+
+	// updates replace the whole token, so everything but the expiry is sent
+	// back as it currently is
+	current, err := c.GetAPIToken(ctx, id.(string))
+	if err != nil {
+		return logical.ErrorResponse("failed to read token before updating its expiration date. err: %s", err), nil
+	}
+	updatedAPIToken := cloudflare.APIToken{
+		Name:      current.Name,
+		Policies:  current.Policies,
+		Condition: current.Condition,
+		NotBefore: current.NotBefore,
+		ExpiresOn: &expirationDate,
+	}
 
 	_, err = c.UpdateAPIToken(ctx, id.(string), updatedAPIToken)
 	if err != nil {
 		return logical.ErrorResponse("failed to update token with new expiration date. err: %s", err), nil
 	}
 
+	if err := b.extendTokenEntry(ctx, req.Storage, id.(string), expirationDate); err != nil {
+		return nil, err
+	}
+
 	resp := &logical.Response{Secret: req.Secret}
-	resp.Secret.TTL = lease.TTL
-	resp.Secret.MaxTTL = lease.MaxTTL
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = roleMaxTTL
 	return resp, nil
 }
 
 func (b *backend) secretTokenRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	c, err := b.client(ctx, req.Storage)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	connection, _ := req.Secret.InternalData["connection"].(string)
+	c, err := b.client(ctx, req.Storage, connection)
 	if err != nil {
 		return nil, err
 	}
 	if c == nil {
 		return nil, fmt.Errorf("error getting cloudflare client")
 	}
+	accountID, _ := req.Secret.InternalData["account_id"].(string)
+	c = c.forAccount(accountID)
 
 	id, ok := req.Secret.InternalData["id"]
 	if !ok {
@@ -100,10 +139,13 @@ func (b *backend) secretTokenRevoke(ctx context.Context, req *logical.Request, d
 	if err != nil {
 		var responseError *cloudflare.APIRequestError
 		// If cloudflare returns 404 that means the token is already deleted
-		if errors.As(err, &responseError) && responseError.HTTPStatusCode() == http.StatusNotFound {
-			return nil, nil
+		if !errors.As(err, &responseError) || responseError.HTTPStatusCode() != http.StatusNotFound {
+			return logical.ErrorResponse(fmt.Sprintf("failed to revoke cloudflare token (%s). err: %s", id, err)), nil
 		}
-		return logical.ErrorResponse(fmt.Sprintf("failed to revoke cloudflare token (%s). err: %s", id, err)), nil
+	}
+
+	if err := req.Storage.Delete(ctx, tokenPrefix+id.(string)); err != nil {
+		return nil, err
 	}
 
 	return nil, nil
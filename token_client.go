@@ -0,0 +1,114 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// tokenClient manages API tokens owned by either the user of the root
+// credential or, when accountID is set, by a cloudflare account. Tokens owned
+// by an account keep working after the user who created them leaves it.
+//
+// cloudflare-go only implements the user-owned token endpoints, so the
+// account-owned equivalents are called through Raw. Raw does not accept a
+// context, so those requests are only bounded by the client's timeout.
+type tokenClient struct {
+	*cloudflare.API
+
+	accountID string
+}
+
+// forAccount returns a client for the tokens owned by accountID, or by the
+// user when accountID is empty, sharing the underlying API client.
+func (c *tokenClient) forAccount(accountID string) *tokenClient {
+	return &tokenClient{API: c.API, accountID: accountID}
+}
+
+func (c *tokenClient) CreateAPIToken(ctx context.Context, token cloudflare.APIToken) (cloudflare.APIToken, error) {
+	if c.accountID == "" {
+		return c.API.CreateAPIToken(ctx, token)
+	}
+
+	var created cloudflare.APIToken
+	err := c.accountRequest(http.MethodPost, "", token, &created)
+	return created, err
+}
+
+func (c *tokenClient) GetAPIToken(ctx context.Context, tokenID string) (cloudflare.APIToken, error) {
+	if c.accountID == "" {
+		return c.API.GetAPIToken(ctx, tokenID)
+	}
+
+	var token cloudflare.APIToken
+	err := c.accountRequest(http.MethodGet, "/"+url.PathEscape(tokenID), nil, &token)
+	return token, err
+}
+
+func (c *tokenClient) UpdateAPIToken(ctx context.Context, tokenID string, token cloudflare.APIToken) (cloudflare.APIToken, error) {
+	if c.accountID == "" {
+		return c.API.UpdateAPIToken(ctx, tokenID, token)
+	}
+
+	var updated cloudflare.APIToken
+	err := c.accountRequest(http.MethodPut, "/"+url.PathEscape(tokenID), token, &updated)
+	return updated, err
+}
+
+func (c *tokenClient) RollAPIToken(ctx context.Context, tokenID string) (string, error) {
+	if c.accountID == "" {
+		return c.API.RollAPIToken(ctx, tokenID)
+	}
+
+	var value string
+	err := c.accountRequest(http.MethodPut, "/"+url.PathEscape(tokenID)+"/value", nil, &value)
+	return value, err
+}
+
+func (c *tokenClient) VerifyAPIToken(ctx context.Context) (cloudflare.APITokenVerifyBody, error) {
+	if c.accountID == "" {
+		return c.API.VerifyAPIToken(ctx)
+	}
+
+	var body cloudflare.APITokenVerifyBody
+	err := c.accountRequest(http.MethodGet, "/verify", nil, &body)
+	return body, err
+}
+
+func (c *tokenClient) DeleteAPIToken(ctx context.Context, tokenID string) error {
+	if c.accountID == "" {
+		return c.API.DeleteAPIToken(ctx, tokenID)
+	}
+
+	return c.accountRequest(http.MethodDelete, "/"+url.PathEscape(tokenID), nil, nil)
+}
+
+func (c *tokenClient) ListAPITokensPermissionGroups(ctx context.Context) ([]cloudflare.APITokenPermissionGroups, error) {
+	if c.accountID == "" {
+		return c.API.ListAPITokensPermissionGroups(ctx)
+	}
+
+	var groups []cloudflare.APITokenPermissionGroups
+	err := c.accountRequest(http.MethodGet, "/permission_groups", nil, &groups)
+	return groups, err
+}
+
+// accountRequest calls the account-owned token endpoint at path and decodes
+// its result into result, if given.
+func (c *tokenClient) accountRequest(method, path string, data, result interface{}) error {
+	res, err := c.Raw(method, "/accounts/"+url.PathEscape(c.accountID)+"/tokens"+path, data)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(res, result); err != nil {
+		return fmt.Errorf("error unmarshalling the JSON response: %w", err)
+	}
+	return nil
+}